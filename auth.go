@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// basicAuthUser and basicAuthPass, if set, are required as HTTP basic
+	// auth credentials on the protected endpoints.
+	basicAuthUser = os.Getenv("WU_BASIC_AUTH_USER")
+	basicAuthPass = os.Getenv("WU_BASIC_AUTH_PASS")
+
+	// bearerToken, if set, is accepted as an "Authorization: Bearer" token on
+	// the protected endpoints.
+	bearerToken = os.Getenv("WU_BEARER_TOKEN")
+)
+
+// requireAuth wraps h so that requests must carry the configured basic auth
+// credentials or bearer token. If neither is configured h is returned as is.
+func requireAuth(h http.Handler) http.Handler {
+	if basicAuthUser == "" && bearerToken == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if basicAuthUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wunderground_exporter"`)
+		}
+		httpError(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func authorized(r *http.Request) bool {
+	if bearerToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, bearerToken) {
+			return true
+		}
+	}
+	if basicAuthUser != "" {
+		user, pass, ok := r.BasicAuth()
+		// Both are compared so that the time taken doesn't reveal which
+		// one was wrong.
+		userOK := secureEqual(user, basicAuthUser)
+		passOK := secureEqual(pass, basicAuthPass)
+		if ok && userOK && passOK {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
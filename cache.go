@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	stationID string
+	units     string
+	precision string
+}
+
+type cacheEntry struct {
+	data    WeatherData
+	fetched time.Time
+}
+
+// weatherCache holds the most recent WeatherData per station so that
+// frequent scrapes don't exhaust the WU API quota. minInterval is the least
+// time between two fetches of a station; unlike the TTL it is meant as a
+// guard against misconfigured scrapers rather than as a cache lifetime.
+type weatherCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	minInterval time.Duration
+	entries     map[cacheKey]cacheEntry
+}
+
+func newWeatherCache(ttl, minInterval time.Duration) *weatherCache {
+	return &weatherCache{
+		ttl:         ttl,
+		minInterval: minInterval,
+		entries:     make(map[cacheKey]cacheEntry),
+	}
+}
+
+// get returns the cached data for the station if it is younger than the TTL
+// or the minimum interval.
+func (c *weatherCache) get(stationID, units, precision string) (WeatherData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey{stationID, units, precision}]
+	if !ok {
+		return WeatherData{}, false
+	}
+	age := time.Since(entry.fetched)
+	if age >= c.ttl && age >= c.minInterval {
+		return WeatherData{}, false
+	}
+	return entry.data, true
+}
+
+// getStale returns the cached data for the station regardless of its age.
+func (c *weatherCache) getStale(stationID, units, precision string) (WeatherData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey{stationID, units, precision}]
+	return entry.data, ok
+}
+
+func (c *weatherCache) set(stationID, units, precision string, data WeatherData) {
+	if c.ttl <= 0 && c.minInterval <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[cacheKey{stationID, units, precision}] = cacheEntry{data: data, fetched: time.Now()}
+}
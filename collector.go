@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+// station is a station to be scraped. Name is the friendly name from the
+// config file, if the station was requested by name. Sensors, if not empty,
+// limits the weather metrics exported for the station. Labels are exported
+// by stationLabelsCollector.
+type station struct {
+	ID        string
+	Name      string
+	Units     string
+	Precision string
+	Sensors   []string
+	Labels    map[string]string
+}
+
+// exports reports whether the weather metric for sensor is exported for the
+// station.
+func (s station) exports(sensor string) bool {
+	if len(s.Sensors) == 0 {
+		return true
+	}
+	for _, name := range s.Sensors {
+		if name == sensor {
+			return true
+		}
+	}
+	return false
+}
+
+// WeatherCollector fetches its stations from the WU API on every collection
+// and exposes the observations as constant metrics built from the shared
+// descriptors. Stations are fetched concurrently, at most maxConcurrency at
+// a time; stations not yet fetched when ctx is done are reported as down.
+// The readings are converted as selected by mode. If pressureUnit is inHg or
+// mmHg, pressure is also exported in that unit. If history is set, the
+// average temperatures of that many past hours are exported too.
+// notFound counts the stations that failed with errStationNotFound, and
+// timedOut those whose fetch timed out.
+type WeatherCollector struct {
+	ctx          context.Context
+	stations     []station
+	mode         outputMode
+	pressureUnit string
+	history      int
+	notFound     atomic.Int32
+	timedOut     atomic.Int32
+}
+
+func (c *WeatherCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upDesc
+	ch <- scrapeDurationDesc
+	ch <- stationInfoDesc
+	ch <- stationUnitsInfoDesc
+	ch <- windInfoDesc
+	ch <- tempHistoryDescs[c.mode]
+	for _, desc := range weatherMetricsFor(c.mode).all() {
+		ch <- desc
+	}
+}
+
+func (c *WeatherCollector) Collect(ch chan<- prometheus.Metric) {
+	var g errgroup.Group
+	g.SetLimit(maxConcurrency)
+	for _, s := range c.stations {
+		s := s
+		g.Go(func() error {
+			c.collectStation(ch, s)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+func (c *WeatherCollector) collectStation(ch chan<- prometheus.Metric, s station) {
+	start := time.Now()
+	var data WeatherData
+	err := c.ctx.Err()
+	if err == nil {
+		ctx, cancel := withStationTimeout(c.ctx)
+		data, err = fetchCachedWeatherData(ctx, s.ID, s.Units, s.Precision)
+		cancel()
+	}
+	duration := time.Since(start)
+	targets.record(s.ID, err)
+	scrapesTotal.Inc()
+	if err != nil {
+		scrapeErrorsTotal.Inc()
+		loggerFor(c.ctx).Warn("Failed to fetch weather data", "station_id", s.ID, "error", err)
+	}
+	if errors.Is(err, errStationNotFound) {
+		c.notFound.Add(1)
+	}
+	if isTimeout(err) {
+		c.timedOut.Add(1)
+	}
+	if err == nil {
+		data.Sensors = withPressureIn(data.Sensors, s.Units, c.pressureUnit)
+	}
+	collectWeatherData(ch, s, data, duration, err, c.mode)
+
+	if c.history > 0 && err == nil && s.exports(sensorTemperature) {
+		c.collectTempHistory(ch, s)
+	}
+}
+
+// collectTempHistory exports the average temperatures of the station's last
+// c.history hourly summaries, converted like the station's temperature. A
+// failure to fetch them is logged but doesn't
+// fail the station.
+func (c *WeatherCollector) collectTempHistory(ch chan<- prometheus.Metric, s station) {
+	ctx, cancel := withStationTimeout(c.ctx)
+	temps, err := fetchCachedHourlyTemperatures(ctx, s.ID, s.Units, s.Precision)
+	cancel()
+	if err != nil {
+		loggerFor(c.ctx).Warn("Failed to fetch hourly history", "station_id", s.ID, "error", err)
+		return
+	}
+
+	if len(temps) > c.history {
+		temps = temps[len(temps)-c.history:]
+	}
+	for i, temp := range temps {
+		hoursAgo := strconv.Itoa(len(temps) - i)
+		temp = convertReadings(map[string]float64{sensorTemperature: temp}, s.Units, c.mode)[sensorTemperature]
+		ch <- prometheus.MustNewConstMetric(tempHistoryDescs[c.mode], prometheus.GaugeValue, temp, s.ID, s.Name, hoursAgo)
+	}
+}
+
+// probeSensors are the sensors whose metrics have a probe label. The reading
+// of a station with a single probe has an empty probe label.
+var probeSensors = map[string]bool{sensorSoilTemperature: true, sensorSoilMoisture: true}
+
+// probeNumbers are the numbers of the probes of a probe sensor.
+var probeNumbers = []string{"1", "2", "3", "4"}
+
+// weatherMetricsFor returns the weather descriptors with help text matching
+// the output mode.
+func weatherMetricsFor(mode outputMode) *weatherMetrics {
+	return weatherMetricSets[mode]
+}
+
+// collectWeatherData emits the metrics for the result of fetching a station.
+func collectWeatherData(ch chan<- prometheus.Metric, s station, data WeatherData, duration time.Duration, err error, mode outputMode) {
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), s.ID, s.Name)
+	ch <- prometheus.MustNewConstMetric(stationUnitsInfoDesc, prometheus.GaugeValue, 1, s.ID, s.Name, s.Units)
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0, s.ID, s.Name)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1, s.ID, s.Name)
+
+	metrics := weatherMetricsFor(mode)
+	sensors := convertReadings(data.Sensors, s.Units, mode)
+
+	labelValues := weatherLabelValues(s, data)
+	for _, sd := range metrics.sensors() {
+		if !s.exports(sd.sensor) {
+			continue
+		}
+		if !probeSensors[sd.sensor] {
+			if value, ok := sensors[sd.sensor]; ok {
+				ch <- prometheus.MustNewConstMetric(sd.desc, prometheus.GaugeValue, value, labelValues...)
+			}
+			continue
+		}
+		if value, ok := sensors[sd.sensor]; ok {
+			ch <- prometheus.MustNewConstMetric(sd.desc, prometheus.GaugeValue, value, append(labelValues, "")...)
+		}
+		for _, probe := range probeNumbers {
+			if value, ok := sensors[probeSensor(sd.sensor, probe)]; ok {
+				ch <- prometheus.MustNewConstMetric(sd.desc, prometheus.GaugeValue, value, append(labelValues, probe)...)
+			}
+		}
+	}
+	// Without epoch or obsTimeUtc the observation time is unknown, and the
+	// age would be counted from 1970.
+	if data.Epoch != 0 && s.exports(sensorEpoch) {
+		ch <- prometheus.MustNewConstMetric(metrics.Epoch, prometheus.GaugeValue, float64(data.Epoch), labelValues...)
+	}
+	if data.Epoch != 0 && s.exports(sensorObservationAge) {
+		age := time.Since(time.Unix(int64(data.Epoch), 0)).Seconds()
+		ch <- prometheus.MustNewConstMetric(metrics.ObservationAge, prometheus.GaugeValue, age, labelValues...)
+	}
+
+	// Prometheus treats the empty obs_time_local as an absent label.
+	obsTimeLocal := ""
+	if obsTimeLocalLabel {
+		obsTimeLocal = data.ObsTimeLocal
+	}
+	ch <- prometheus.MustNewConstMetric(stationInfoDesc, prometheus.GaugeValue, 1,
+		s.ID, s.Name, qcStatusName(data.QCStatus), obsTimeLocal, data.SoftwareType, stationMode(data))
+
+	if dir, ok := data.Sensors[sensorWindDirection]; ok && s.exports(sensorWindDirection) {
+		ch <- prometheus.MustNewConstMetric(windInfoDesc, prometheus.GaugeValue, 1,
+			s.ID, s.Name, cardinalDirection(dir))
+	}
+}
+
+var cardinalDirections = []string{
+	"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE",
+	"S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW",
+}
+
+// cardinalDirection returns the 16-point compass direction for a bearing in
+// degrees. Each point covers 22.5°, centred on its bearing, so 348.75° up to
+// 11.25° (exclusive) is N.
+func cardinalDirection(degrees float64) string {
+	idx := int(math.Floor(math.Mod(degrees, 360)/22.5+0.5)) % len(cardinalDirections)
+	if idx < 0 {
+		idx += len(cardinalDirections)
+	}
+	return cardinalDirections[idx]
+}
+
+// qcStatusName returns a readable name for an observation's qcStatus.
+func qcStatusName(status int) string {
+	switch status {
+	case 1:
+		return "passed"
+	case -1:
+		return "failed"
+	default:
+		return "none"
+	}
+}
+
+// rapidFireMaxFrequency is the longest realtime update interval, in seconds,
+// of a station in rapid-fire mode. Stations reporting less often are in
+// standard mode.
+const rapidFireMaxFrequency = 60
+
+// stationMode returns whether the station is in rapid-fire mode, reporting
+// realtime updates every few seconds, or in standard mode.
+func stationMode(data WeatherData) string {
+	if freq, ok := data.Sensors[sensorRealtimeFrequency]; ok && freq > 0 && freq <= rapidFireMaxFrequency {
+		return "rapidfire"
+	}
+	return "standard"
+}
+
+// weatherLabelValues returns the values of weatherLabels for a station.
+func weatherLabelValues(s station, data WeatherData) []string {
+	values := make([]string, len(weatherLabels))
+	for i, label := range weatherLabels {
+		switch label {
+		case "stationID":
+			values[i] = s.ID
+		case "station_name":
+			values[i] = s.Name
+		case "neighborhood":
+			values[i] = data.Neighborhood
+		case "softwareType":
+			values[i] = data.SoftwareType
+		case "country":
+			values[i] = data.Country
+		}
+	}
+	return values
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var fqNamePattern = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+// collectTestMetrics runs collectWeatherData for s and data in the default
+// output mode and returns the values of the series it emits, keyed by metric
+// name, with "/<probe>" appended for series with a probe label.
+func collectTestMetrics(t *testing.T, s station, data WeatherData) map[string]float64 {
+	t.Helper()
+
+	ch := make(chan prometheus.Metric, 100)
+	collectWeatherData(ch, s, data, time.Second, nil, outputMode{})
+	close(ch)
+
+	series := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("writing metric: %v", err)
+		}
+		key := fqNamePattern.FindStringSubmatch(m.Desc().String())[1]
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "probe" {
+				key += "/" + label.GetValue()
+			}
+		}
+		series[key] = pb.GetGauge().GetValue()
+	}
+	return series
+}
+
+func TestWeatherMetricsComplete(t *testing.T) {
+	for mode, m := range weatherMetricSets {
+		v := reflect.ValueOf(m).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).IsNil() {
+				t.Errorf("%+v: %s has no descriptor", mode, v.Type().Field(i).Name)
+			}
+		}
+		if got, want := len(m.all()), v.NumField(); got != want {
+			t.Errorf("%+v: all() returns %d descriptors, want %d", mode, got, want)
+		}
+	}
+}
+
+func TestWeatherMetricsHasSensor(t *testing.T) {
+	for _, sensor := range []string{sensorTemperature, sensorSoilMoisture, sensorEpoch, sensorObservationAge} {
+		if !defaultWeatherMetrics.hasSensor(sensor) {
+			t.Errorf("hasSensor(%q) = false, want true", sensor)
+		}
+	}
+	if defaultWeatherMetrics.hasSensor("temprature") {
+		t.Error(`hasSensor("temprature") = true, want false`)
+	}
+}
+
+func TestStationMode(t *testing.T) {
+	tests := []struct {
+		sensors map[string]float64
+		want    string
+	}{
+		{map[string]float64{}, "standard"},
+		{map[string]float64{sensorRealtimeFrequency: 0}, "standard"},
+		{map[string]float64{sensorRealtimeFrequency: 2.5}, "rapidfire"},
+		{map[string]float64{sensorRealtimeFrequency: 60}, "rapidfire"},
+		{map[string]float64{sensorRealtimeFrequency: 300}, "standard"},
+	}
+	for _, tt := range tests {
+		if got := stationMode(WeatherData{Sensors: tt.sensors}); got != tt.want {
+			t.Errorf("stationMode(%v) = %q, want %q", tt.sensors, got, tt.want)
+		}
+	}
+}
+
+func TestCollectWeatherDataAllowlist(t *testing.T) {
+	s := station{ID: "KTEST1", Units: "m", Sensors: []string{sensorTemperature}}
+	data := WeatherData{
+		StationID: "KTEST1",
+		Epoch:     1791967800,
+		Sensors:   map[string]float64{sensorTemperature: 14.2, sensorHumidity: 82},
+	}
+
+	series := collectTestMetrics(t, s, data)
+	if _, ok := series[metricName("temp")]; !ok {
+		t.Errorf("temp is missing from %v", series)
+	}
+	for _, name := range []string{"humidity", "epoch", "observation_age_seconds"} {
+		if _, ok := series[metricName(name)]; ok {
+			t.Errorf("%s is exported, but isn't in the sensors allowlist", name)
+		}
+	}
+}
+
+func TestCollectWeatherDataUnknownEpoch(t *testing.T) {
+	data := WeatherData{StationID: "KTEST1", Sensors: map[string]float64{sensorTemperature: 14.2}}
+
+	series := collectTestMetrics(t, station{ID: "KTEST1", Units: "m"}, data)
+	for _, name := range []string{"epoch", "observation_age_seconds"} {
+		if v, ok := series[metricName(name)]; ok {
+			t.Errorf("%s = %v is exported without an observation time", name, v)
+		}
+	}
+	if _, ok := series[metricName("temp")]; !ok {
+		t.Errorf("temp is missing from %v", series)
+	}
+}
+
+func TestCardinalDirection(t *testing.T) {
+	tests := []struct {
+		degrees float64
+		want    string
+	}{
+		{0, "N"},
+		{348.74, "NNW"},
+		{348.75, "N"},
+		{11.24, "N"},
+		{11.25, "NNE"},
+		{90, "E"},
+		{202.5, "SSW"},
+		{360, "N"},
+		{-10, "N"},
+		{-90, "W"},
+	}
+	for _, tt := range tests {
+		if got := cardinalDirection(tt.degrees); got != tt.want {
+			t.Errorf("cardinalDirection(%v) = %q, want %q", tt.degrees, got, tt.want)
+		}
+	}
+}
+
+func TestTempHistoryOutputMode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		stationID := r.URL.Query().Get("stationId")
+		if strings.HasSuffix(r.URL.Path, hourlyHistoryPath) {
+			fmt.Fprintf(w, `{"observations":[{"stationID":%q,"epoch":1791964200,"metric":{"tempAvg":10},"imperial":{"tempAvg":50}}]}`, stationID)
+			return
+		}
+		w.Write([]byte(strings.Replace(observationJSON, "KTEST1", stationID, 1)))
+	}))
+	defer srv.Close()
+	useTestAPI(t, srv.URL)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"station_id=KHIST1", "10"},
+		{"station_id=KHIST2&temp_unit=kelvin", "283.15"},
+		{"station_id=KHIST3&units=e", "50"},
+		{"station_id=KHIST4&units=e&normalize=si", "10"},
+		{"station_id=KHIST5&units=e&temp_unit=kelvin", "283.15"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleScrape(rec, httptest.NewRequest(http.MethodGet, "/scrape?history=1&"+tt.query, nil))
+		want := fmt.Sprintf(`%s{hours_ago="1",`, metricName("temp_history"))
+		var got string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, want) {
+				got = line[strings.LastIndex(line, " ")+1:]
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: temp_history = %q, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the static configuration loaded from the file named by WU_CONFIG.
+//
+//	stations:
+//	  backyard:
+//	    station_id: KCASANFR123
+//	    units: e
+//	    sensors: [temperature, humidity, pressure]
+type Config struct {
+	Stations map[string]StationConfig `yaml:"stations"`
+}
+
+// StationConfig maps a friendly station name to its PWS station ID. If
+// Sensors is set, only those weather metrics are exported for the station.
+// Labels are the target labels of stations loaded from a file_sd file.
+type StationConfig struct {
+	StationID string            `yaml:"station_id"`
+	Units     string            `yaml:"units"`
+	Sensors   []string          `yaml:"sensors"`
+	Labels    map[string]string `yaml:"-"`
+}
+
+var (
+	configMu sync.RWMutex
+	config   = &Config{}
+)
+
+// currentConfig returns the configuration in effect. It may be replaced
+// while the exporter runs, so callers shouldn't hold on to it.
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+func setConfig(c *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = c
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("validating %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	for name, sc := range c.Stations {
+		if !stationIDPattern.MatchString(sc.StationID) {
+			return fmt.Errorf("station %q: invalid station_id %q", name, sc.StationID)
+		}
+		if sc.Units != "" && !validUnits[sc.Units] {
+			return fmt.Errorf("station %q: units must be one of m, e, h or s", name)
+		}
+		for _, sensor := range sc.Sensors {
+			if !defaultWeatherMetrics.hasSensor(sensor) {
+				return fmt.Errorf("station %q: unknown sensor %q", name, sensor)
+			}
+		}
+	}
+	return nil
+}
+
+// withStations returns a copy of c with the given stations added. Stations
+// already in c take precedence.
+func (c *Config) withStations(stations map[string]StationConfig) *Config {
+	merged := &Config{Stations: make(map[string]StationConfig, len(c.Stations)+len(stations))}
+	for name, sc := range stations {
+		merged.Stations[name] = sc
+	}
+	for name, sc := range c.Stations {
+		merged.Stations[name] = sc
+	}
+	return merged
+}
+
+// stations returns the configured stations sorted by name, with units
+// defaulting to defaultUnits.
+func (c *Config) stations() []station {
+	names := make([]string, 0, len(c.Stations))
+	for name := range c.Stations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stations := make([]station, 0, len(names))
+	for _, name := range names {
+		sc := c.Stations[name]
+		s := station{ID: sc.StationID, Name: name, Units: sc.Units, Precision: defaultPrecision, Sensors: sc.Sensors, Labels: sc.Labels}
+		if s.Units == "" {
+			s.Units = defaultUnits
+		}
+		stations = append(stations, s)
+	}
+	return stations
+}
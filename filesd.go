@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fileSDGroup is a target group of a Prometheus file_sd JSON file:
+//
+//	[{"targets": ["KCASANFR123"], "labels": {"site": "home"}}]
+//
+// The targets are station IDs, which are also used as the station names.
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// loadFileSD returns the stations listed in the file_sd file at path.
+func loadFileSD(path string) (map[string]StationConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []fileSDGroup
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	stations := make(map[string]StationConfig)
+	for _, g := range groups {
+		for name := range g.Labels {
+			if !labelNamePattern.MatchString(name) || name == "stationID" || name == "station_name" {
+				return nil, fmt.Errorf("%s: invalid label name %q", path, name)
+			}
+			// station_labels is exported with WU_EXTRA_LABELS added, which
+			// fails the whole gather if a label is given twice.
+			if _, ok := extraLabels[name]; ok {
+				return nil, fmt.Errorf("%s: label name %q is already set by WU_EXTRA_LABELS", path, name)
+			}
+		}
+		for _, id := range g.Targets {
+			if !stationIDPattern.MatchString(id) {
+				return nil, fmt.Errorf("%s: invalid station ID %q", path, id)
+			}
+			stations[id] = StationConfig{StationID: id, Labels: g.Labels}
+		}
+	}
+	return stations, nil
+}
+
+// fileSDWatcher keeps the configuration's file_sd stations in sync with the
+// file, on top of the stations of base.
+type fileSDWatcher struct {
+	mu       sync.Mutex
+	path     string
+	base     *Config
+	modTime  time.Time
+	stations map[string]StationConfig
+}
+
+func newFileSDWatcher(path string, base *Config) *fileSDWatcher {
+	return &fileSDWatcher{path: path, base: base}
+}
+
+// reload loads the file if it has changed since the last successful load.
+func (w *fileSDWatcher) reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(w.modTime) {
+		return nil
+	}
+
+	stations, err := loadFileSD(w.path)
+	if err != nil {
+		return err
+	}
+	w.modTime = info.ModTime()
+	w.stations = stations
+	setConfig(w.base.withStations(stations))
+	logger.Info("Loaded file_sd stations", "path", w.path, "stations", len(stations))
+	return nil
+}
+
+// setBase replaces the configuration the file_sd stations are added to.
+func (w *fileSDWatcher) setBase(base *Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.base = base
+	setConfig(base.withStations(w.stations))
+}
+
+// run checks the file for changes every interval until ctx is done. A file
+// that fails to load leaves the previous stations in place.
+func (w *fileSDWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := w.reload(); err != nil {
+			logger.Warn("Failed to reload file_sd stations", "path", w.path, "error", err)
+		}
+	}
+}
+
+// stationLabelsCollector exports the file_sd labels of the stations as an
+// info metric. It is an unchecked collector, as the label names differ from
+// one target group to the next.
+type stationLabelsCollector struct {
+	stations func() []station
+}
+
+func (c *stationLabelsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *stationLabelsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.stations() {
+		if len(s.Labels) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(s.Labels))
+		for name := range s.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		values := []string{s.ID, s.Name}
+		for _, name := range names {
+			values = append(values, s.Labels[name])
+		}
+
+		desc := prometheus.NewDesc(
+			metricName("station_labels"),
+			"Target labels of the station from the file_sd file, always 1",
+			append([]string{"stationID", "station_name"}, names...), nil,
+		)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeFileSD(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stations.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileSD(t *testing.T) {
+	path := writeFileSD(t, `[{"targets": ["KCASANFR123", "KNYNEWYO9"], "labels": {"site": "home"}}]`)
+
+	stations, err := loadFileSD(path)
+	if err != nil {
+		t.Fatalf("loadFileSD: %v", err)
+	}
+	if len(stations) != 2 {
+		t.Fatalf("got %d stations, want 2", len(stations))
+	}
+	sc := stations["KCASANFR123"]
+	if sc.StationID != "KCASANFR123" || sc.Labels["site"] != "home" {
+		t.Errorf("KCASANFR123 = %+v", sc)
+	}
+}
+
+func TestLoadFileSDRejectsExtraLabelClash(t *testing.T) {
+	saved := extraLabels
+	extraLabels = prometheus.Labels{"region": "us"}
+	t.Cleanup(func() { extraLabels = saved })
+
+	path := writeFileSD(t, `[{"targets": ["KCASANFR123"], "labels": {"region": "a"}}]`)
+	_, err := loadFileSD(path)
+	if err == nil || !strings.Contains(err.Error(), "WU_EXTRA_LABELS") {
+		t.Errorf("loadFileSD error = %v, want a clash with WU_EXTRA_LABELS", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// Command-line flags, following the Prometheus naming conventions. Each
+// defaults to the environment variable named in its usage, so a flag takes
+// precedence over the environment.
+var (
+	listenAddress  = flag.String("web.listen-address", defaultListenAddress(), "Address to listen on (WU_LISTEN_ADDRESS, or :PORT)")
+	configFile     = flag.String("config.file", os.Getenv("WU_CONFIG"), "Path of the station config file (WU_CONFIG)")
+	fileSDFile     = flag.String("file-sd.file", os.Getenv("WU_FILE_SD"), "Path of a Prometheus file_sd file listing stations (WU_FILE_SD)")
+	apiKeysFlag    = flag.String("api.key", "", "WU API key, or comma-separated keys (WU_API_KEYS, WU_API_KEY)")
+	logLevel       = flag.String("log.level", os.Getenv("LOG_LEVEL"), "Log level: debug, info, warn or error (LOG_LEVEL)")
+	validateConfig = flag.Bool("validate", false, "Load the config, fetch each configured station once, print the results and exit")
+)
+
+func init() {
+	flag.StringVar(&apiKeyFile, "api.key-file", apiKeyFile, "File to read the WU API key from on every request (WU_API_KEY_FILE)")
+	flag.StringVar(&apiBaseURL, "api.base-url", apiBaseURL, "Base URL of the WU API (WU_API_BASE_URL)")
+	flag.DurationVar(&httpClient.Timeout, "api.timeout", httpClient.Timeout, "Timeout of a single WU API request (WU_HTTP_TIMEOUT)")
+	flag.IntVar(&maxConcurrency, "api.concurrency", maxConcurrency, "Maximum number of stations fetched at once (WU_CONCURRENCY)")
+	flag.DurationVar(&cache.ttl, "cache.ttl", cache.ttl, "How long fetched observations are cached (WU_CACHE_TTL)")
+	flag.StringVar(&metricsPath, "web.telemetry-path", metricsPath, "Path of the exporter's own metrics (WU_METRICS_PATH)")
+	flag.StringVar(&scrapePath, "web.scrape-path", scrapePath, "Path of the per-station scrape endpoint (WU_SCRAPE_PATH)")
+}
+
+// defaultListenAddress returns the listen address set by the environment.
+func defaultListenAddress() string {
+	if address := os.Getenv("WU_LISTEN_ADDRESS"); address != "" {
+		return address
+	}
+	return ":" + stringFromEnv("PORT", defaultPort)
+}
+
+// parseFlags parses the command line and applies the flags that settings
+// derived at startup depend on.
+func parseFlags() {
+	flag.Parse()
+
+	if *logLevel != os.Getenv("LOG_LEVEL") {
+		logger = newLogger(*logLevel)
+	}
+	if *apiKeysFlag != "" {
+		apiKeys = newKeyPool(*apiKeysFlag, apiKeys.cooldown)
+	}
+}
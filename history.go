@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// historyDateLayout is the date format accepted by the history API.
+const historyDateLayout = "20060102"
+
+const (
+	// maxHistoryHours is the largest number of hourly temperatures a scrape
+	// may ask for with the history parameter.
+	maxHistoryHours = 24
+
+	// hourlyHistoryTTL is how long the hourly summaries of a station are
+	// cached. They only change once an hour, so this is independent of
+	// WU_CACHE_TTL.
+	hourlyHistoryTTL = 10 * time.Minute
+)
+
+var (
+	historyMetrics = newHistoryMetrics()
+
+	tempHistoryDescs = newTempHistoryDescs()
+
+	hourlyCache = &hourlyHistoryCache{entries: make(map[cacheKey]hourlyHistoryEntry)}
+)
+
+// newTempHistoryDescs returns the temp_history descriptor of each output
+// mode, as the help text gives the temperature unit.
+func newTempHistoryDescs() map[outputMode]*prometheus.Desc {
+	descs := make(map[outputMode]*prometheus.Desc)
+	for mode := range weatherMetricSets {
+		unit := "degrees Celsius (°F with units=e)"
+		switch {
+		case mode.tempUnit == "kelvin":
+			unit = "kelvins"
+		case mode.normalize == "si":
+			unit = "degrees Celsius"
+		}
+		descs[mode] = prometheus.NewDesc(
+			metricName("temp_history"),
+			"Average air temperature of the hour hours_ago hours back in "+unit+", exported with history=N",
+			[]string{"stationID", "station_name", "hours_ago"}, nil,
+		)
+	}
+	return descs
+}
+
+// newHistoryMetrics returns the daily summary gauge descriptors keyed by
+// sensor name. As with newWeatherMetrics, the help text describes the metric
+// (units=m) readings.
+func newHistoryMetrics() map[string]*prometheus.Desc {
+	labels := []string{"stationID", "station_name", "date"}
+	return map[string]*prometheus.Desc{
+		"temperature_high": prometheus.NewDesc(
+			metricName("temp_high"),
+			"Daily high air temperature in degrees Celsius",
+			labels, nil,
+		),
+		"temperature_low": prometheus.NewDesc(
+			metricName("temp_low"),
+			"Daily low air temperature in degrees Celsius",
+			labels, nil,
+		),
+		"temperature_avg": prometheus.NewDesc(
+			metricName("temp_avg"),
+			"Daily average air temperature in degrees Celsius",
+			labels, nil,
+		),
+		"precipitation_total": prometheus.NewDesc(
+			metricName("precip_total_daily"),
+			"Daily total precipitation in millimeters (inches with units=e)",
+			labels, nil,
+		),
+	}
+}
+
+type HistoryObservation struct {
+	Observations []DailySummary `json:"observations"`
+}
+
+type DailySummary struct {
+	StationID    string              `json:"stationID"`
+	ObsTimeLocal string              `json:"obsTimeLocal"`
+	Epoch        int                 `json:"epoch"`
+	Metric       HistoryMeasurements `json:"metric"`
+	Imperial     HistoryMeasurements `json:"imperial"`
+	UKHybrid     HistoryMeasurements `json:"uk_hybrid"`
+	MetricSI     HistoryMeasurements `json:"metric_si"`
+}
+
+// HistoryMeasurements holds the unit-dependent daily summary readings.
+type HistoryMeasurements struct {
+	TempHigh    float64 `json:"tempHigh"`
+	TempLow     float64 `json:"tempLow"`
+	TempAvg     float64 `json:"tempAvg"`
+	PrecipTotal float64 `json:"precipTotal"`
+}
+
+// measurements returns the readings for the requested unit system.
+func (d DailySummary) measurements(units string) HistoryMeasurements {
+	switch units {
+	case "e":
+		return d.Imperial
+	case "h":
+		return d.UKHybrid
+	case "s":
+		return d.MetricSI
+	default:
+		return d.Metric
+	}
+}
+
+// fetchDailyHistory fetches the daily summary for a station on the given
+// date (YYYYMMDD) and returns its readings keyed by sensor name.
+func fetchDailyHistory(ctx context.Context, baseURL, stationID, units, precision, date string) (sensors map[string]float64, err error) {
+	start := time.Now()
+	var statusCode int
+	defer func() {
+		recordFetch(ctx, stationID, start, statusCode, err)
+	}()
+
+	var body []byte
+	body, statusCode, err = fetchAPI(ctx, baseURL, dailyHistoryPath, url.Values{
+		"stationId":        {stationID},
+		"units":            {units},
+		"numericPrecision": {precision},
+		"date":             {date},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == http.StatusNoContent {
+		return nil, fmt.Errorf("%w for station %s on %s", errNoObservations, stationID, date)
+	}
+
+	var history HistoryObservation
+	if err := json.Unmarshal(body, &history); err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecode, err)
+	}
+	if len(history.Observations) == 0 {
+		return nil, fmt.Errorf("%w for station %s on %s", errNoObservations, stationID, date)
+	}
+
+	m := history.Observations[0].measurements(units)
+	return map[string]float64{
+		"temperature_high":    m.TempHigh,
+		"temperature_low":     m.TempLow,
+		"temperature_avg":     m.TempAvg,
+		"precipitation_total": m.PrecipTotal,
+	}, nil
+}
+
+// HistoryCollector fetches the daily summary of its stations for one date on
+// every collection.
+type HistoryCollector struct {
+	ctx      context.Context
+	stations []station
+	date     string
+}
+
+func (c *HistoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upDesc
+	ch <- scrapeDurationDesc
+	for _, desc := range historyMetrics {
+		ch <- desc
+	}
+}
+
+func (c *HistoryCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.stations {
+		start := time.Now()
+		sensors, err := fetchDailyHistory(c.ctx, apiBaseURL, s.ID, s.Units, s.Precision, c.date)
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), s.ID, s.Name)
+		if err != nil {
+			loggerFor(c.ctx).Warn("Failed to fetch daily history", "station_id", s.ID, "date", c.date, "error", err)
+			ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0, s.ID, s.Name)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1, s.ID, s.Name)
+
+		for sensor, value := range sensors {
+			if desc, ok := historyMetrics[sensor]; ok {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, s.ID, s.Name, c.date)
+			}
+		}
+	}
+}
+
+// fetchHourlyTemperatures fetches the hourly summaries of the last 7 days for
+// a station and returns their average temperatures, oldest first.
+func fetchHourlyTemperatures(ctx context.Context, baseURL, stationID, units, precision string) (temps []float64, err error) {
+	start := time.Now()
+	var statusCode int
+	defer func() {
+		recordFetch(ctx, stationID, start, statusCode, err)
+	}()
+
+	var body []byte
+	body, statusCode, err = fetchAPI(ctx, baseURL, hourlyHistoryPath, url.Values{
+		"stationId":        {stationID},
+		"units":            {units},
+		"numericPrecision": {precision},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == http.StatusNoContent {
+		return nil, fmt.Errorf("%w for station %s", errNoObservations, stationID)
+	}
+
+	var history HistoryObservation
+	if err := json.Unmarshal(body, &history); err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecode, err)
+	}
+
+	observations := history.Observations
+	sort.Slice(observations, func(i, j int) bool { return observations[i].Epoch < observations[j].Epoch })
+	temps = make([]float64, len(observations))
+	for i, obs := range observations {
+		temps[i] = obs.measurements(units).TempAvg
+	}
+	return temps, nil
+}
+
+type hourlyHistoryEntry struct {
+	temps   []float64
+	fetched time.Time
+}
+
+// hourlyHistoryCache holds the hourly temperatures per station for
+// hourlyHistoryTTL.
+type hourlyHistoryCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]hourlyHistoryEntry
+}
+
+func (c *hourlyHistoryCache) get(key cacheKey) ([]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.fetched) >= hourlyHistoryTTL {
+		return nil, false
+	}
+	return entry.temps, true
+}
+
+func (c *hourlyHistoryCache) set(key cacheKey, temps []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = hourlyHistoryEntry{temps: temps, fetched: time.Now()}
+}
+
+// fetchCachedHourlyTemperatures returns the station's hourly temperatures
+// from hourlyCache, fetching them if they aren't cached.
+func fetchCachedHourlyTemperatures(ctx context.Context, stationID, units, precision string) ([]float64, error) {
+	key := cacheKey{stationID, units, precision}
+	if temps, ok := hourlyCache.get(key); ok {
+		return temps, nil
+	}
+
+	temps, err := fetchHourlyTemperatures(ctx, apiBaseURL, stationID, units, precision)
+	if err != nil {
+		return nil, err
+	}
+	hourlyCache.set(key, temps)
+	return temps, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPool hands out API keys round-robin so that the request load, and with
+// it the daily quota, is spread across several keys. A key that was rejected
+// or rate limited is skipped until its cooldown has passed.
+type keyPool struct {
+	mu       sync.Mutex
+	keys     []string
+	next     int
+	cooldown time.Duration
+	disabled map[string]time.Time
+}
+
+// newKeyPool returns a pool of the comma-separated keys in value.
+func newKeyPool(value string, cooldown time.Duration) *keyPool {
+	p := &keyPool{
+		cooldown: cooldown,
+		disabled: make(map[string]time.Time),
+	}
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			p.keys = append(p.keys, key)
+		}
+	}
+	return p
+}
+
+// pick returns the next usable key. If every key is cooling down, the one
+// that becomes usable first is returned rather than failing the request.
+func (p *keyPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.keys) == 0 {
+		return ""
+	}
+
+	now := time.Now()
+	fallback := -1
+	for i := 0; i < len(p.keys); i++ {
+		idx := (p.next + i) % len(p.keys)
+		until, ok := p.disabled[p.keys[idx]]
+		if !ok || now.After(until) {
+			delete(p.disabled, p.keys[idx])
+			p.next = idx + 1
+			return p.keys[idx]
+		}
+		if fallback == -1 || until.Before(p.disabled[p.keys[fallback]]) {
+			fallback = idx
+		}
+	}
+
+	p.next = fallback + 1
+	return p.keys[fallback]
+}
+
+// disable takes the key out of rotation for the pool's cooldown.
+func (p *keyPool) disable(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.disabled[key] = time.Now().Add(p.cooldown)
+}
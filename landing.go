@@ -0,0 +1,38 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// landingLink is an endpoint listed on the landing page.
+type landingLink struct {
+	Path        string
+	Description string
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Weather Underground Exporter</title></head>
+<body>
+<h1>Weather Underground Exporter</h1>
+<p>Version {{.Version}}</p>
+<ul>
+{{- range .Links}}
+<li><a href="{{.Path}}">{{.Path}}</a>: {{.Description}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// landingPage returns a handler for an HTML page listing links.
+func landingPage(links []landingLink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingTemplate.Execute(w, struct {
+			Version string
+			Links   []landingLink
+		}{version, links})
+	})
+}
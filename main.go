@@ -1,298 +1,1729 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 const (
-	defaultPort        = "9122"
-	weatherAPIEndpoint = "https://api.weather.com/v2/pws/observations/current?stationId=%s&format=json&apiKey=%s&units=m&numericPrecision=decimal"
+	defaultPort                = "9122"
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultCacheTTL            = 60 * time.Second
+	defaultMaxRetries          = 2
+	shutdownTimeout            = 30 * time.Second
+	defaultKeyCooldown         = 5 * time.Minute
+	defaultRetryDelay          = 200 * time.Millisecond
+	defaultConcurrency         = 4
+	defaultPushInterval        = 60 * time.Second
+	defaultPollJitter          = 0.1
+	defaultStuckThreshold      = time.Hour
+	defaultFileSDRefresh       = 30 * time.Second
+	defaultScrapeTimeoutOffset = 500 * time.Millisecond
+	defaultUnits               = "m"
+	defaultPrecision           = "decimal"
+	defaultAPIBaseURL          = "https://api.weather.com"
+	currentObsPath             = "/v2/pws/observations/current"
+	dailyHistoryPath           = "/v2/pws/history/daily"
+	hourlyHistoryPath          = "/v2/pws/observations/hourly/7day"
 )
 
 var (
-	apiKey = os.Getenv("WU_API_KEY")
+	logger = newLogger(os.Getenv("LOG_LEVEL"))
+
+	// apiKeys holds the keys from the comma-separated WU_API_KEYS, or the
+	// single WU_API_KEY. Keys that get a 401 or 429 are skipped for
+	// WU_API_KEY_COOLDOWN.
+	apiKeys = newKeyPool(stringFromEnv("WU_API_KEYS", os.Getenv("WU_API_KEY")),
+		durationFromEnv("WU_API_KEY_COOLDOWN", defaultKeyCooldown))
+
+	// apiKeyFile, if set, takes precedence over WU_API_KEYS and is re-read on
+	// every request so that a rotated key is picked up without a restart.
+	apiKeyFile = os.Getenv("WU_API_KEY_FILE")
+
+	// apiKeyInHeader sends the API key as the X-Api-Key header instead of
+	// the apiKey query parameter.
+	apiKeyInHeader = os.Getenv("WU_API_KEY_IN_HEADER") == "true"
+
+	// apiBaseURL can point at a proxy or caching layer in front of the WU API.
+	apiBaseURL = stringFromEnv("WU_API_BASE_URL", defaultAPIBaseURL)
+
+	// userAgent is sent with every request to the WU API.
+	userAgent = stringFromEnv("WU_USER_AGENT", "wunderground_exporter/"+version)
+
+	// metricsPath and scrapePath are the paths of the exporter's own metrics
+	// and of the per-station scrape endpoint.
+	metricsPath = stringFromEnv("WU_METRICS_PATH", "/metrics")
+	scrapePath  = stringFromEnv("WU_SCRAPE_PATH", "/scrape")
+
+	// healthCheckStation, if set, is fetched by /healthz to verify that the
+	// API key is accepted.
+	healthCheckStation = os.Getenv("WU_HEALTHCHECK_STATION")
+
+	// metricPrefix is prepended to the names of all exported metrics.
+	metricPrefix = stringFromEnv("WU_METRIC_PREFIX", "wunderground")
+
+	// metricPrefixPattern matches prefixes that form valid metric names.
+	metricPrefixPattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	// stationIDPattern matches PWS station IDs such as KCASANFR123.
+	stationIDPattern = regexp.MustCompile(`^[A-Z0-9]{1,32}$`)
+
+	// validUnits are the unit systems accepted by the WU API:
+	//
+	//	m  metric:    °C, km/h, hPa, mm, m
+	//	e  English:   °F, mph, inHg, in, ft
+	//	h  UK hybrid: °C, mph, hPa, mm, ft
+	//	s  metric SI: °C, m/s, hPa, mm, m
+	//
+	// Values are exported as returned by the API, without conversion.
+	validUnits = map[string]bool{"m": true, "e": true, "h": true, "s": true}
+
+	httpClient = &http.Client{
+		Timeout: durationFromEnv("WU_HTTP_TIMEOUT", defaultHTTPTimeout),
+	}
+
+	// stationTimeout, if positive, bounds the time spent fetching a single
+	// station, retries included, so that one slow station doesn't use up
+	// the whole scrape.
+	stationTimeout = durationFromEnv("WU_STATION_TIMEOUT", 0)
+
+	// scrapeTimeoutOffset is subtracted from the scrape timeout Prometheus
+	// sends, so that the exporter gives up on the API and responds before
+	// Prometheus gives up on the exporter.
+	scrapeTimeoutOffset = durationFromEnv("WU_SCRAPE_TIMEOUT_OFFSET", defaultScrapeTimeoutOffset)
+
+	// validateReadings drops readings outside of validRanges.
+	validateReadings = os.Getenv("WU_VALIDATE") == "true"
+
+	// pollJitter is the fraction of the poll interval by which each
+	// station's background polls are randomly delayed.
+	pollJitter = floatFromEnv("WU_POLL_JITTER", defaultPollJitter)
+
+	// stuckThreshold is how long a polled station may keep returning the
+	// same observation before it is reported as stuck.
+	stuckThreshold = durationFromEnv("WU_STUCK_THRESHOLD", defaultStuckThreshold)
+
+	// maxRetries is the number of times a failed request is retried, with
+	// the delay doubling after each attempt.
+	maxRetries = intFromEnv("WU_MAX_RETRIES", defaultMaxRetries)
+	retryDelay = durationFromEnv("WU_RETRY_DELAY", defaultRetryDelay)
+
+	// maxConcurrency limits the number of stations fetched in parallel by a
+	// single scrape.
+	maxConcurrency = intFromEnv("WU_CONCURRENCY", defaultConcurrency)
+
+	// apiLimiter caps the rate of upstream requests to WU_RATE_LIMIT per
+	// minute. It is unlimited by default.
+	apiLimiter = newRateLimiter(intFromEnv("WU_RATE_LIMIT", 0))
+
+	cache = newWeatherCache(durationFromEnv("WU_CACHE_TTL", defaultCacheTTL),
+		durationFromEnv("WU_MIN_SCRAPE_INTERVAL", 0))
+
+	targets = newTargetTracker()
+
+	// extraLabels are added to every metric exported, other than the Go
+	// runtime and process metrics.
+	extraLabels = extraLabelsFromEnv("WU_EXTRA_LABELS")
+
+	// weatherLabels are the labels attached to the weather gauges, in order.
+	weatherLabels = weatherLabelsFromEnv("WU_LABELS")
+
+	// obsTimeLocalLabel adds the local observation time to station_info. It
+	// is off by default because the label changes with every observation.
+	obsTimeLocalLabel = os.Getenv("WU_OBS_TIME_LOCAL_LABEL") == "true"
+
+	// weatherMetricSets holds the weather descriptors for each output mode,
+	// as their help texts differ. defaultWeatherMetrics is the default set.
+	weatherMetricSets     = newWeatherMetricSets()
+	defaultWeatherMetrics = weatherMetricSets[outputMode{}]
+
+	upDesc = prometheus.NewDesc(
+		metricName("up"),
+		"Whether the Weather Underground API fetch succeeded",
+		[]string{"stationID", "station_name"}, nil,
+	)
+	stationInfoDesc = prometheus.NewDesc(
+		metricName("station_info"),
+		"Information about the station's latest observation, always 1",
+		[]string{"stationID", "station_name", "qc_status", "obs_time_local", "software_type", "mode"}, nil,
+	)
+	stationUnitsInfoDesc = prometheus.NewDesc(
+		metricName("station_units_info"),
+		"Unit system the station's readings were requested in, always 1",
+		[]string{"stationID", "station_name", "units"}, nil,
+	)
+	windInfoDesc = prometheus.NewDesc(
+		metricName("wind_info"),
+		"16-point compass direction of the wind, always 1",
+		[]string{"stationID", "station_name", "cardinal"}, nil,
+	)
+	scrapeDurationDesc = prometheus.NewDesc(
+		metricName("scrape_duration_seconds"),
+		"Duration of the Weather Underground API fetch in seconds",
+		[]string{"stationID", "station_name"}, nil,
+	)
+)
+
+// newLogger returns a JSON logger at the given level (debug, info, warn or
+// error), defaulting to info.
+func newLogger(level string) *slog.Logger {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			l = slog.LevelInfo
+		}
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l}))
+}
+
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// metricName returns the name of a metric with metricPrefix prepended.
+func metricName(name string) string {
+	return metricPrefix + "_" + name
+}
+
+func stringFromEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Invalid duration", "key", key, "error", err)
+	}
+	return d
+}
+
+func floatFromEnv(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fatal("Invalid number", "key", key, "error", err)
+	}
+	return f
+}
+
+func intFromEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Invalid integer", "key", key, "error", err)
+	}
+	return n
+}
+
+// allWeatherLabels are the labels available for the weather gauges.
+var allWeatherLabels = []string{"stationID", "station_name", "neighborhood", "softwareType", "country"}
+
+// weatherLabelsFromEnv parses a comma-separated subset of allWeatherLabels,
+// which must include stationID, defaulting to all of them.
+func weatherLabelsFromEnv(key string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return allWeatherLabels
+	}
+
+	known := make(map[string]bool, len(allWeatherLabels))
+	for _, label := range allWeatherLabels {
+		known[label] = true
+	}
+
+	labels := strings.Split(value, ",")
+	hasStationID := false
+	for _, label := range labels {
+		if !known[label] {
+			fatal("Unknown label", "key", key, "label", label, "allowed", allWeatherLabels)
+		}
+		if label == "stationID" {
+			hasStationID = true
+		}
+	}
+	if !hasStationID {
+		fatal("Labels must include stationID", "key", key)
+	}
+	return labels
+}
+
+// labelNamePattern matches valid Prometheus label names.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// extraLabelsFromEnv parses comma-separated name=value pairs.
+func extraLabelsFromEnv(key string) prometheus.Labels {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	labels := prometheus.Labels{}
+	for _, pair := range strings.Split(value, ",") {
+		name, labelValue, ok := strings.Cut(pair, "=")
+		if !ok || !labelNamePattern.MatchString(name) {
+			fatal("Invalid label, expected name=value", "key", key, "label", pair)
+		}
+		labels[name] = labelValue
+	}
+	return labels
+}
+
+func newRateLimiter(perMinute int) *rate.Limiter {
+	if perMinute <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(float64(perMinute)/60), 1)
+}
+
+// outputMode selects the conversions applied to the readings of a scrape:
+// normalize is "", "si" or "mm" and tempUnit is "" (Celsius) or "kelvin".
+type outputMode struct {
+	normalize string
+	tempUnit  string
+}
+
+// Sensor names, the keys of WeatherData.Sensors and of the weather metric
+// descriptors. Referring to sensors by these rather than by string literals
+// makes a misspelt sensor a compile error rather than a metric that is
+// silently never exported.
+const (
+	sensorTemperature        = "temperature"
+	sensorDewPoint           = "dewpoint"
+	sensorHumidity           = "humidity"
+	sensorPressure           = "pressure"
+	sensorWindSpeed          = "windspeed"
+	sensorWindDirection      = "winddirection"
+	sensorWindGust           = "windgust"
+	sensorPrecipitationRate  = "precipitation_rate"
+	sensorPrecipitationTotal = "precipitation_total"
+	sensorUVIndex            = "uv_index"
+	sensorSolarRadiation     = "solar_radiation"
+	sensorEpoch              = "epoch"
+	sensorObservationAge     = "observation_age"
+	sensorVisibility         = "visibility"
+	sensorSoilTemperature    = "soil_temperature"
+	sensorSoilMoisture       = "soil_moisture"
+	sensorWindChill          = "windchill"
+	sensorHeatIndex          = "heatindex"
+	sensorElevation          = "elevation"
+	sensorQCStatus           = "qc_status"
+	sensorRealtimeFrequency  = "realtime_frequency"
+	sensorLatitude           = "latitude"
+	sensorLongitude          = "longitude"
+	sensorFeelsLike          = "feels_like"
+	sensorDewPointSpread     = "dewpoint_spread"
+	sensorWetBulb            = "wetbulb"
+	sensorAbsoluteHumidity   = "absolute_humidity"
+	sensorPressureInHg       = "pressure_inhg"
+	sensorPressureMMHg       = "pressure_mmhg"
 )
 
-func newWeatherMetrics() map[string]*prometheus.GaugeVec {
-	labels := []string{"stationID", "neighborhood", "softwareType", "country"}
-	return map[string]*prometheus.GaugeVec{
-		"temperature": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_temp",
-				Help: "Air temperature in degrees Celsius",
-			},
-			labels,
+// weatherMetrics holds the weather gauge descriptors of an output mode, one
+// per sensor. Epoch and ObservationAge are computed from the observation
+// time; the others export the reading of the sensor of the same name.
+type weatherMetrics struct {
+	Temperature        *prometheus.Desc
+	DewPoint           *prometheus.Desc
+	Humidity           *prometheus.Desc
+	Pressure           *prometheus.Desc
+	WindSpeed          *prometheus.Desc
+	WindDirection      *prometheus.Desc
+	WindGust           *prometheus.Desc
+	PrecipitationRate  *prometheus.Desc
+	PrecipitationTotal *prometheus.Desc
+	UVIndex            *prometheus.Desc
+	SolarRadiation     *prometheus.Desc
+	Epoch              *prometheus.Desc
+	ObservationAge     *prometheus.Desc
+	Visibility         *prometheus.Desc
+	SoilTemperature    *prometheus.Desc
+	SoilMoisture       *prometheus.Desc
+	WindChill          *prometheus.Desc
+	HeatIndex          *prometheus.Desc
+	Elevation          *prometheus.Desc
+	QCStatus           *prometheus.Desc
+	RealtimeFrequency  *prometheus.Desc
+	Latitude           *prometheus.Desc
+	Longitude          *prometheus.Desc
+	FeelsLike          *prometheus.Desc
+	DewPointSpread     *prometheus.Desc
+	WetBulb            *prometheus.Desc
+	AbsoluteHumidity   *prometheus.Desc
+	PressureInHg       *prometheus.Desc
+	PressureMMHg       *prometheus.Desc
+}
+
+// sensorDesc pairs a sensor with the descriptor its readings are exported
+// with.
+type sensorDesc struct {
+	sensor string
+	desc   *prometheus.Desc
+}
+
+// sensors returns the descriptors of the readings in WeatherData.Sensors.
+func (m *weatherMetrics) sensors() []sensorDesc {
+	return []sensorDesc{
+		{sensorTemperature, m.Temperature},
+		{sensorDewPoint, m.DewPoint},
+		{sensorHumidity, m.Humidity},
+		{sensorPressure, m.Pressure},
+		{sensorWindSpeed, m.WindSpeed},
+		{sensorWindDirection, m.WindDirection},
+		{sensorWindGust, m.WindGust},
+		{sensorPrecipitationRate, m.PrecipitationRate},
+		{sensorPrecipitationTotal, m.PrecipitationTotal},
+		{sensorUVIndex, m.UVIndex},
+		{sensorSolarRadiation, m.SolarRadiation},
+		{sensorVisibility, m.Visibility},
+		{sensorSoilTemperature, m.SoilTemperature},
+		{sensorSoilMoisture, m.SoilMoisture},
+		{sensorWindChill, m.WindChill},
+		{sensorHeatIndex, m.HeatIndex},
+		{sensorElevation, m.Elevation},
+		{sensorQCStatus, m.QCStatus},
+		{sensorRealtimeFrequency, m.RealtimeFrequency},
+		{sensorLatitude, m.Latitude},
+		{sensorLongitude, m.Longitude},
+		{sensorFeelsLike, m.FeelsLike},
+		{sensorDewPointSpread, m.DewPointSpread},
+		{sensorWetBulb, m.WetBulb},
+		{sensorAbsoluteHumidity, m.AbsoluteHumidity},
+		{sensorPressureInHg, m.PressureInHg},
+		{sensorPressureMMHg, m.PressureMMHg},
+	}
+}
+
+// all returns every descriptor, for Describe.
+func (m *weatherMetrics) all() []*prometheus.Desc {
+	descs := []*prometheus.Desc{m.Epoch, m.ObservationAge}
+	for _, sd := range m.sensors() {
+		descs = append(descs, sd.desc)
+	}
+	return descs
+}
+
+// hasSensor reports whether sensor names one of the metrics, as accepted by
+// the sensors allowlist of a station.
+func (m *weatherMetrics) hasSensor(sensor string) bool {
+	if sensor == sensorEpoch || sensor == sensorObservationAge {
+		return true
+	}
+	for _, sd := range m.sensors() {
+		if sd.sensor == sensor {
+			return true
+		}
+	}
+	return false
+}
+
+// newWeatherMetricSets returns the weather descriptors for every outputMode.
+func newWeatherMetricSets() map[outputMode]*weatherMetrics {
+	speedUnits := map[string]string{"": "kilometers per hour", "si": "meters per second", "mm": "kilometers per hour"}
+	precipUnits := map[string]string{"": "millimeters (inches with units=e)", "si": "millimeters", "mm": "millimeters"}
+	tempUnits := map[string]string{"": "degrees Celsius", "kelvin": "kelvins"}
+
+	sets := make(map[outputMode]*weatherMetrics)
+	for normalize, speedUnit := range speedUnits {
+		for tempUnit, tempUnitName := range tempUnits {
+			mode := outputMode{normalize: normalize, tempUnit: tempUnit}
+			sets[mode] = newWeatherMetrics(speedUnit, precipUnits[normalize], tempUnitName)
+		}
+	}
+	return sets
+}
+
+// newWeatherMetrics returns the weather gauge descriptors.
+// The help text describes the metric (units=m) readings, with temperatures in
+// tempUnit, wind speeds in speedUnit and precipitation in precipUnit; when
+// another unit system is requested the values are exported as returned by the
+// API unless normalize=si or normalize=mm is set.
+func newWeatherMetrics(speedUnit, precipUnit, tempUnit string) *weatherMetrics {
+	labels := weatherLabels
+	probeLabels := append(append([]string{}, labels...), "probe")
+	return &weatherMetrics{
+		Temperature: prometheus.NewDesc(
+			metricName("temp"),
+			"Air temperature in "+tempUnit,
+			labels, nil,
+		),
+		DewPoint: prometheus.NewDesc(
+			metricName("dewpt"),
+			"Dew point temperature in "+tempUnit,
+			labels, nil,
+		),
+		Humidity: prometheus.NewDesc(
+			metricName("humidity"),
+			"Relative humidity in percentage",
+			labels, nil,
+		),
+		Pressure: prometheus.NewDesc(
+			metricName("pressure"),
+			"Atmospheric pressure at sea level in hectopascals",
+			labels, nil,
 		),
-		"dewpoint": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_dewpt",
-				Help: "Dew point temperature in degrees Celsius",
-			},
-			labels,
+		WindSpeed: prometheus.NewDesc(
+			metricName("windSpeed"),
+			"Wind speed in "+speedUnit,
+			labels, nil,
 		),
-		"humidity": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_humidity",
-				Help: "Relative humidity in percentage",
-			},
-			labels,
+		WindDirection: prometheus.NewDesc(
+			metricName("windDir"),
+			"Wind direction in degrees",
+			labels, nil,
 		),
-		"pressure": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_pressure",
-				Help: "Atmospheric pressure at sea level in hectopascals",
-			},
-			labels,
+		WindGust: prometheus.NewDesc(
+			metricName("windGust"),
+			"Wind gust speed in "+speedUnit,
+			labels, nil,
 		),
-		"windspeed": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_windSpeed",
-				Help: "Wind speed in meters per second",
-			},
-			labels,
+		PrecipitationRate: prometheus.NewDesc(
+			metricName("precipRate"),
+			"Precipitation rate in "+precipUnit+" per hour",
+			labels, nil,
 		),
-		"winddirection": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_windDir",
-				Help: "Wind direction in degrees",
-			},
-			labels,
+		PrecipitationTotal: prometheus.NewDesc(
+			metricName("precipTotal"),
+			"Total accumulated precipitation in "+precipUnit,
+			labels, nil,
 		),
-		"windgust": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_windGust",
-				Help: "Wind gust speed in meters per second",
-			},
-			labels,
+		UVIndex: prometheus.NewDesc(
+			metricName("uv"),
+			"Ultraviolet Index",
+			labels, nil,
 		),
-		"precipitation_rate": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_precipRate",
-				Help: "Precipitation rate in millimeters per hour",
-			},
-			labels,
+		SolarRadiation: prometheus.NewDesc(
+			metricName("solarRadiation"),
+			"Solar radiation in watts per square meter",
+			labels, nil,
 		),
-		"precipitation_total": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_precipTotal",
-				Help: "Total accumulated precipitation in millimeters",
-			},
-			labels,
+		Epoch: prometheus.NewDesc(
+			metricName("epoch"),
+			"Epoch time in seconds",
+			labels, nil,
 		),
-		"uv_index": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_uv",
-				Help: "Ultraviolet Index",
-			},
-			labels,
+		ObservationAge: prometheus.NewDesc(
+			metricName("observation_age_seconds"),
+			"Time since the observation was made in seconds",
+			labels, nil,
 		),
-		"solar_radiation": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_solarRadiation",
-				Help: "Solar radiation in watts per square meter",
-			},
-			labels,
+		Visibility: prometheus.NewDesc(
+			metricName("visibility"),
+			"Visibility in meters",
+			labels, nil,
 		),
-		"epoch": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_epoch",
-				Help: "Epoch time in seconds",
-			},
-			labels,
+		SoilTemperature: prometheus.NewDesc(
+			metricName("soilTemp"),
+			"Soil temperature in "+tempUnit+", by probe for stations with several",
+			probeLabels, nil,
 		),
-		"visibility": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_visibility",
-				Help: "Visibility in meters",
-			},
-			labels,
+		SoilMoisture: prometheus.NewDesc(
+			metricName("soilMoisture"),
+			"Soil moisture in percentage, by probe for stations with several",
+			probeLabels, nil,
 		),
-		"soil_temperature": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_soilTemp",
-				Help: "Soil temperature in degrees Celsius",
-			},
-			labels,
+		WindChill: prometheus.NewDesc(
+			metricName("windChill"),
+			"Wind chill temperature in "+tempUnit,
+			labels, nil,
 		),
-		"soil_moisture": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_soilMoisture",
-				Help: "Soil moisture in percentage",
-			},
-			labels,
+		HeatIndex: prometheus.NewDesc(
+			metricName("heatIndex"),
+			"Heat index in "+tempUnit,
+			labels, nil,
 		),
-		"windchill": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_windChill",
-				Help: "Wind chill temperature in degrees Celsius",
-			},
-			labels,
+		Elevation: prometheus.NewDesc(
+			metricName("elevation"),
+			"Elevation in meters",
+			labels, nil,
 		),
-		"elevation": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_elevation",
-				Help: "Elevation in meters",
-			},
-			labels,
+		QCStatus: prometheus.NewDesc(
+			metricName("qc_status"),
+			"Quality control status of the observation (-1 failed, 0 not checked, 1 passed)",
+			labels, nil,
 		),
-		"latitude": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_latitude",
-				Help: "Latitude",
-			},
-			labels,
+		RealtimeFrequency: prometheus.NewDesc(
+			metricName("realtime_frequency_seconds"),
+			"Interval at which the station reports realtime updates in seconds",
+			labels, nil,
 		),
-		"longitude": prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "wunderground_longitude",
-				Help: "Longitude",
-			},
-			labels,
+		Latitude: prometheus.NewDesc(
+			metricName("latitude"),
+			"Latitude",
+			labels, nil,
+		),
+		Longitude: prometheus.NewDesc(
+			metricName("longitude"),
+			"Longitude",
+			labels, nil,
+		),
+		FeelsLike: prometheus.NewDesc(
+			metricName("feels_like"),
+			"Apparent temperature in "+tempUnit+": the heat index above 26 °C, the wind chill below 10 °C and the air temperature otherwise",
+			labels, nil,
+		),
+		DewPointSpread: prometheus.NewDesc(
+			metricName("dewpoint_spread"),
+			"Difference between the air temperature and the dew point in "+tempUnit,
+			labels, nil,
+		),
+		WetBulb: prometheus.NewDesc(
+			metricName("wetbulb"),
+			"Wet-bulb temperature in "+tempUnit+", computed from the air temperature and humidity with Stull's approximation",
+			labels, nil,
+		),
+		AbsoluteHumidity: prometheus.NewDesc(
+			metricName("absolute_humidity"),
+			"Water vapour content of the air in grams per cubic meter, computed from the air temperature and humidity with the Magnus formula",
+			labels, nil,
+		),
+		PressureInHg: prometheus.NewDesc(
+			metricName("pressure_inhg"),
+			"Atmospheric pressure at sea level in inches of mercury, exported with pressure_unit=inHg",
+			labels, nil,
+		),
+		PressureMMHg: prometheus.NewDesc(
+			metricName("pressure_mmhg"),
+			"Atmospheric pressure at sea level in millimeters of mercury, exported with pressure_unit=mmHg",
+			labels, nil,
 		),
 	}
 }
 
 type WeatherObservation struct {
-	Observations []struct {
-		StationID         string      `json:"stationID"`
-		ObsTimeUTC        string      `json:"obsTimeUtc"`
-		ObsTimeLocal      string      `json:"obsTimeLocal"`
-		Neighborhood      string      `json:"neighborhood"`
-		SoftwareType      string      `json:"softwareType"`
-		Country           string      `json:"country"`
-		SolarRadiation    float64     `json:"solarRadiation"`
-		Lat               float64     `json:"lat"`
-		Lon               float64     `json:"lon"`
-		RealtimeFrequency interface{} `json:"realtimeFrequency"`
-		Epoch             int         `json:"epoch"`
-		UV                float64     `json:"uv"`
-		WindDir           int         `json:"winddir"`
-		Humidity          float64     `json:"humidity"`
-		QCStatus          int         `json:"qcStatus"`
-		Metric            struct {
-			Temp        float64 `json:"temp"`
-			HeatIndex   float64 `json:"heatIndex"`
-			DewPt       float64 `json:"dewpt"`
-			WindChill   float64 `json:"windChill"`
-			WindSpeed   float64 `json:"windSpeed"`
-			WindGust    float64 `json:"windGust"`
-			Pressure    float64 `json:"pressure"`
-			PrecipRate  float64 `json:"precipRate"`
-			PrecipTotal float64 `json:"precipTotal"`
-			Elev        float64 `json:"elev"`
-		} `json:"metric"`
-	} `json:"observations"`
+	Observations []Observation `json:"observations"`
+}
+
+// decodeWeatherObservation decodes a current observations response. Unknown
+// fields are ignored so that additions to the API don't break the exporter,
+// but unexpected top-level keys are logged at debug level as a hint of
+// schema changes. A response without an observations key is an errDecode,
+// while an empty or null array is returned as no observations.
+func decodeWeatherObservation(ctx context.Context, stationID string, body []byte) (WeatherObservation, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return WeatherObservation{}, fmt.Errorf("%w: %v", errDecode, err)
+	}
+
+	for key := range fields {
+		if key != "observations" {
+			loggerFor(ctx).Debug("Unexpected key in API response", "station_id", stationID, "key", key)
+		}
+	}
+
+	raw, ok := fields["observations"]
+	if !ok {
+		return WeatherObservation{}, fmt.Errorf("%w: observations missing", errDecode)
+	}
+
+	var weatherObservation WeatherObservation
+	if err := json.Unmarshal(raw, &weatherObservation.Observations); err != nil {
+		return WeatherObservation{}, fmt.Errorf("%w: %v", errDecode, err)
+	}
+	return weatherObservation, nil
+}
+
+type Observation struct {
+	StationID         string       `json:"stationID"`
+	ObsTimeUTC        string       `json:"obsTimeUtc"`
+	ObsTimeLocal      string       `json:"obsTimeLocal"`
+	Neighborhood      string       `json:"neighborhood"`
+	SoftwareType      string       `json:"softwareType"`
+	Country           string       `json:"country"`
+	SolarRadiation    *float64     `json:"solarRadiation"`
+	Lat               float64      `json:"lat"`
+	Lon               float64      `json:"lon"`
+	RealtimeFrequency interface{}  `json:"realtimeFrequency"`
+	Epoch             int          `json:"epoch"`
+	UV                *float64     `json:"uv"`
+	WindDir           *float64     `json:"winddir"`
+	Humidity          *float64     `json:"humidity"`
+	SoilMoisture      *float64     `json:"soilMoisture"`
+	SoilMoisture1     *float64     `json:"soilMoisture1"`
+	SoilMoisture2     *float64     `json:"soilMoisture2"`
+	SoilMoisture3     *float64     `json:"soilMoisture3"`
+	SoilMoisture4     *float64     `json:"soilMoisture4"`
+	QCStatus          int          `json:"qcStatus"`
+	Metric            Measurements `json:"metric"`
+	Imperial          Measurements `json:"imperial"`
+	UKHybrid          Measurements `json:"uk_hybrid"`
+	MetricSI          Measurements `json:"metric_si"`
+}
+
+// Measurements holds the unit-dependent readings of an observation. The API
+// returns them in an object named after the requested unit system. Fields
+// are nil if the station doesn't report them.
+type Measurements struct {
+	Temp        *float64 `json:"temp"`
+	HeatIndex   *float64 `json:"heatIndex"`
+	DewPt       *float64 `json:"dewpt"`
+	WindChill   *float64 `json:"windChill"`
+	WindSpeed   *float64 `json:"windSpeed"`
+	WindGust    *float64 `json:"windGust"`
+	Pressure    *float64 `json:"pressure"`
+	PrecipRate  *float64 `json:"precipRate"`
+	PrecipTotal *float64 `json:"precipTotal"`
+	Elev        *float64 `json:"elev"`
+	SoilTemp    *float64 `json:"soilTemp"`
+	Visibility  *float64 `json:"visibility"`
+
+	// Stations with several soil probes report them numbered.
+	SoilTemp1 *float64 `json:"soilTemp1"`
+	SoilTemp2 *float64 `json:"soilTemp2"`
+	SoilTemp3 *float64 `json:"soilTemp3"`
+	SoilTemp4 *float64 `json:"soilTemp4"`
+}
+
+// measurements returns the readings for the requested unit system.
+func (o Observation) measurements(units string) Measurements {
+	switch units {
+	case "e":
+		return o.Imperial
+	case "h":
+		return o.UKHybrid
+	case "s":
+		return o.MetricSI
+	default:
+		return o.Metric
+	}
 }
 
 type WeatherData struct {
 	StationID    string
 	Epoch        int
+	ObsTime      time.Time
+	ObsTimeLocal string
+	QCStatus     int
 	Latitude     float64
 	Longitude    float64
-	Elevation    float64
 	Neighborhood string
 	SoftwareType string
 	Country      string
 	Sensors      map[string]float64
 }
 
-func fetchWeatherData(stationID string) (WeatherData, error) {
-	url := fmt.Sprintf(weatherAPIEndpoint, stationID, apiKey)
-	resp, err := http.Get(url)
+var (
+	errNoObservations = errors.New("no observations returned")
+	errDecode         = errors.New("invalid API response")
+	errRateLimited    = errors.New("rate limited")
+	errStale          = errors.New("serving stale cached data after an invalid API response")
+
+	// errStationNotFound wraps the errors that mean the station doesn't
+	// exist or has nothing to report, as opposed to an API or exporter
+	// fault.
+	errStationNotFound = errors.New("station not found")
+)
+
+// apiError is returned when the WU API responds with an unexpected status.
+// Code and Message are taken from the API's JSON error envelope, if any.
+type apiError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Body       string
+}
+
+func newAPIError(statusCode int, body []byte) *apiError {
+	e := &apiError{StatusCode: statusCode, Body: string(body)}
+
+	var envelope struct {
+		Errors []struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && len(envelope.Errors) > 0 {
+		e.Code = envelope.Errors[0].Error.Code
+		e.Message = envelope.Errors[0].Error.Message
+	}
+	return e
+}
+
+func (e *apiError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("API request failed with status %d: %s (%s)", e.StatusCode, e.Message, e.Code)
+	}
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// fetchBody performs a single GET request and returns the response status and
+// body, or an *apiError if the status is not 200 or 204. If headerKey is set
+// it is sent as the X-Api-Key header.
+func fetchBody(ctx context.Context, requestURL, headerKey string) (_ []byte, _ int, err error) {
+	// Errors about the request URL, whether it fails to parse or to be
+	// fetched, include it and the API key it carries.
+	defer func() {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
 	if err != nil {
-		return WeatherData{}, err
+		return nil, 0, err
+	}
+	if headerKey != "" {
+		req.Header.Set("X-Api-Key", headerKey)
+	}
+
+	// Setting Accept-Encoding ourselves turns off the transport's transparent
+	// decompression, so gzip responses are decoded below. This is done so
+	// that the bytes actually received can be counted.
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("User-Agent", userAgent)
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	apiDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "" {
+		if v, err := strconv.ParseFloat(remaining, 64); err == nil {
+			apiQuotaRemaining.WithLabelValues().Set(v)
+		}
+	}
+
+	// The API answers 204 No Content for stations without recent data; the
+	// caller reports that as having no observations.
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, resp.StatusCode, nil
+	}
+
+	counter := &countingReader{r: resp.Body}
+	defer func() {
+		apiReceivedBytesTotal.Add(float64(counter.n))
+	}()
+
+	var reader io.Reader = counter
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			return nil, resp.StatusCode, fmt.Errorf("%w: %v", errDecode, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := io.ReadAll(reader)
 	if err != nil {
-		return WeatherData{}, err
+		return nil, resp.StatusCode, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return WeatherData{}, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, resp.StatusCode, newAPIError(resp.StatusCode, body)
 	}
+	return body, resp.StatusCode, nil
+}
 
-	var weatherObservation WeatherObservation
-	err = json.Unmarshal(body, &weatherObservation)
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// redactURL replaces the apiKey query parameter of a request URL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<unparseable URL>"
+	}
+	query := u.Query()
+	if query.Get("apiKey") != "" {
+		query.Set("apiKey", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// getAPIKey returns the API key from WU_API_KEY_FILE if set, or the next key
+// of the pool.
+func getAPIKey() (string, error) {
+	if apiKeyFile == "" {
+		return apiKeys.pick(), nil
+	}
+
+	b, err := os.ReadFile(apiKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("reading API key: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// isRetryable reports whether a failed request is worth retrying: network
+// errors and 5xx responses are, while 4xx responses (bad key, unknown
+// station) are not.
+func isRetryable(err error) bool {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// fetchAPI requests the given API path with the common query parameters
+// added, retrying transient failures, and returns the response status and
+// body.
+func fetchAPI(ctx context.Context, baseURL, path string, query url.Values) (body []byte, statusCode int, err error) {
+	ctx, span := tracer.Start(ctx, "GET "+path, trace.WithAttributes(
+		attribute.String("station_id", query.Get("stationId")),
+		attribute.String("units", query.Get("units")),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	key, err := getAPIKey()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Sending the key in a header keeps it out of access and proxy logs.
+	var headerKey string
+	query.Set("format", "json")
+	if apiKeyInHeader {
+		headerKey = key
+	} else {
+		query.Set("apiKey", key)
+	}
+	requestURL := strings.TrimSuffix(baseURL, "/") + path + "?" + query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		if err := apiLimiter.Wait(ctx); err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errRateLimited, err)
+		}
+
+		body, statusCode, err = fetchBody(ctx, requestURL, headerKey)
+		if statusCode == http.StatusUnauthorized || statusCode == http.StatusTooManyRequests {
+			apiKeys.disable(key)
+		}
+		if err == nil || attempt >= maxRetries || !isRetryable(err) {
+			return body, statusCode, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, statusCode, ctx.Err()
+		case <-time.After(retryDelay << attempt):
+		}
+	}
+}
+
+// withStationTimeout returns a context for fetching a single station, with
+// stationTimeout applied if set.
+func withStationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if stationTimeout > 0 {
+		return context.WithTimeout(ctx, stationTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isTimeout reports whether err is the result of a timeout or cancellation
+// rather than an error response.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withScrapeTimeout returns a copy of ctx with the deadline of the Prometheus
+// scrape of r, less scrapeTimeoutOffset. ctx is returned as is if r has no
+// X-Prometheus-Scrape-Timeout-Seconds header.
+func withScrapeTimeout(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - scrapeTimeoutOffset
+	if timeout <= 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// recordFetch logs the outcome of an API fetch at debug level and updates
+// the API request counters.
+func recordFetch(ctx context.Context, stationID string, start time.Time, statusCode int, err error) {
+	loggerFor(ctx).Debug("Fetched weather data",
+		"station_id", stationID,
+		"status_code", statusCode,
+		"duration_ms", time.Since(start).Milliseconds(),
+		"error", err,
+	)
+
+	apiRequestsTotal.Inc()
+	if statusCode != 0 {
+		apiLastStatusCode.WithLabelValues(stationID).Set(float64(statusCode))
+	}
+	if err != nil {
+		apiRequestErrorsTotal.WithLabelValues(errorType(err)).Inc()
+	}
+	if errors.Is(err, errDecode) {
+		decodeErrorsTotal.Inc()
+	}
+}
+
+func fetchWeatherData(ctx context.Context, baseURL, stationID, units, precision string) (data WeatherData, err error) {
+	start := time.Now()
+	var statusCode int
+	defer func() {
+		recordFetch(ctx, stationID, start, statusCode, err)
+	}()
+
+	var body []byte
+	body, statusCode, err = fetchAPI(ctx, baseURL, currentObsPath, url.Values{
+		"stationId":        {stationID},
+		"units":            {units},
+		"numericPrecision": {precision},
+	})
 	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %w", errStationNotFound, err)
+		}
 		return WeatherData{}, err
 	}
+	if statusCode == http.StatusNoContent {
+		return WeatherData{}, fmt.Errorf("%w: %w for station %s", errStationNotFound, errNoObservations, stationID)
+	}
+
+	weatherObservation, err := decodeWeatherObservation(ctx, stationID, body)
+	if err != nil {
+		return WeatherData{}, err
+	}
+
+	if len(weatherObservation.Observations) == 0 {
+		return WeatherData{}, fmt.Errorf("%w: %w for station %s", errStationNotFound, errNoObservations, stationID)
+	}
 
 	obs := weatherObservation.Observations[0]
+	m := obs.measurements(units)
+
+	// obsTimeUtc is informational; fall back to it only if epoch is missing.
+	obsTime, parseErr := time.Parse(time.RFC3339, obs.ObsTimeUTC)
+	if parseErr != nil {
+		loggerFor(ctx).Debug("Failed to parse obsTimeUtc", "station_id", stationID, "value", obs.ObsTimeUTC, "error", parseErr)
+	}
+	epoch := obs.Epoch
+	if epoch == 0 && parseErr == nil {
+		epoch = int(obsTime.Unix())
+	}
 
-	data := WeatherData{
+	data = WeatherData{
 		StationID:    stationID,
-		Epoch:        obs.Epoch,
+		Epoch:        epoch,
+		ObsTime:      obsTime,
+		ObsTimeLocal: obs.ObsTimeLocal,
+		QCStatus:     obs.QCStatus,
 		Latitude:     obs.Lat,
 		Longitude:    obs.Lon,
-		Elevation:    obs.Metric.Elev,
 		Neighborhood: obs.Neighborhood,
 		SoftwareType: obs.SoftwareType,
 		Country:      obs.Country,
 		Sensors: map[string]float64{
-			"temperature":         obs.Metric.Temp,
-			"dewpoint":            obs.Metric.DewPt,
-			"humidity":            obs.Humidity,
-			"pressure":            obs.Metric.Pressure,
-			"windspeed":           obs.Metric.WindSpeed,
-			"winddirection":       float64(obs.WindDir),
-			"windgust":            obs.Metric.WindGust,
-			"precipitation_rate":  obs.Metric.PrecipRate,
-			"precipitation_total": obs.Metric.PrecipTotal,
-			"uv_index":            obs.UV,
-			"solar_radiation":     obs.SolarRadiation,
+			sensorLatitude:  obs.Lat,
+			sensorLongitude: obs.Lon,
+			sensorQCStatus:  float64(obs.QCStatus),
 		},
 	}
 
+	// Sensors the station doesn't have are reported as null or left out, and
+	// aren't exported rather than exported as a misleading zero.
+	for sensor, value := range map[string]*float64{
+		sensorTemperature:        m.Temp,
+		sensorDewPoint:           m.DewPt,
+		sensorPressure:           m.Pressure,
+		sensorWindSpeed:          m.WindSpeed,
+		sensorWindGust:           m.WindGust,
+		sensorPrecipitationRate:  m.PrecipRate,
+		sensorPrecipitationTotal: m.PrecipTotal,
+		sensorWindChill:          m.WindChill,
+		sensorHeatIndex:          m.HeatIndex,
+		sensorSoilTemperature:    m.SoilTemp,
+		sensorVisibility:         m.Visibility,
+		sensorElevation:          m.Elev,
+		sensorHumidity:           obs.Humidity,
+		sensorWindDirection:      obs.WindDir,
+		sensorUVIndex:            obs.UV,
+		sensorSolarRadiation:     obs.SolarRadiation,
+		sensorSoilMoisture:       obs.SoilMoisture,
+
+		probeSensor(sensorSoilTemperature, "1"): m.SoilTemp1,
+		probeSensor(sensorSoilTemperature, "2"): m.SoilTemp2,
+		probeSensor(sensorSoilTemperature, "3"): m.SoilTemp3,
+		probeSensor(sensorSoilTemperature, "4"): m.SoilTemp4,
+		probeSensor(sensorSoilMoisture, "1"):    obs.SoilMoisture1,
+		probeSensor(sensorSoilMoisture, "2"):    obs.SoilMoisture2,
+		probeSensor(sensorSoilMoisture, "3"):    obs.SoilMoisture3,
+		probeSensor(sensorSoilMoisture, "4"):    obs.SoilMoisture4,
+	} {
+		if value != nil {
+			data.Sensors[sensor] = *value
+		}
+	}
+
+	if validateReadings {
+		dropInvalidReadings(ctx, stationID, data.Sensors)
+	}
+
+	addDerivedReadings(data.Sensors, units)
+
+	// realtimeFrequency is null for most stations.
+	if freq, ok := realtimeFrequency(obs.RealtimeFrequency); ok {
+		data.Sensors[sensorRealtimeFrequency] = freq
+	}
+
 	return data, nil
 }
 
+// addDerivedReadings adds the readings computed from the station's own to
+// sensors. They are only added if the air temperature is known; feels_like
+// falls back to it for a missing wind chill or heat index.
+func addDerivedReadings(sensors map[string]float64, units string) {
+	temp, ok := sensors[sensorTemperature]
+	if !ok {
+		return
+	}
+
+	windChill, ok := sensors[sensorWindChill]
+	if !ok {
+		windChill = temp
+	}
+	heatIndex, ok := sensors[sensorHeatIndex]
+	if !ok {
+		heatIndex = temp
+	}
+	sensors[sensorFeelsLike] = feelsLike(temp, windChill, heatIndex, units)
+
+	if dewpoint, ok := sensors[sensorDewPoint]; ok {
+		sensors[sensorDewPointSpread] = temp - dewpoint
+	}
+	if humidity, ok := sensors[sensorHumidity]; ok {
+		sensors[sensorWetBulb] = wetBulb(temp, humidity, units)
+		sensors[sensorAbsoluteHumidity] = absoluteHumidity(temp, humidity, units)
+	}
+}
+
+// realtimeFrequency returns the realtimeFrequency of an observation, which is
+// a number, null or, from some stations, a numeric string.
+func realtimeFrequency(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// validRanges are the plausible ranges of sensors whose faulty readings are
+// easy to tell apart.
+var validRanges = map[string]struct{ min, max float64 }{
+	sensorHumidity:      {0, 100},
+	sensorUVIndex:       {0, 20},
+	sensorWindDirection: {0, 360},
+}
+
+// dropInvalidReadings removes the readings outside of validRanges from
+// sensors, counting them in invalidReadingsTotal.
+func dropInvalidReadings(ctx context.Context, stationID string, sensors map[string]float64) {
+	for sensor, r := range validRanges {
+		value, ok := sensors[sensor]
+		if !ok || (value >= r.min && value <= r.max) {
+			continue
+		}
+		loggerFor(ctx).Debug("Dropped invalid reading", "station_id", stationID, "sensor", sensor, "value", value)
+		invalidReadingsTotal.WithLabelValues(sensor).Inc()
+		delete(sensors, sensor)
+	}
+}
+
+// probeSensor returns the Sensors key of a numbered probe of a sensor.
+func probeSensor(sensor, probe string) string {
+	return sensor + "/" + probe
+}
+
+// fetchCachedWeatherData returns the cached data for the station if it is
+// still fresh, and otherwise fetches it with fetchWeatherDataOrStale.
+func fetchCachedWeatherData(ctx context.Context, stationID, units, precision string) (WeatherData, error) {
+	if data, ok := cache.get(stationID, units, precision); ok {
+		return data, nil
+	}
+	data, _, err := fetchWeatherDataOrStale(ctx, stationID, units, precision)
+	return data, err
+}
+
+// fetchWeatherDataOrStale fetches a station's current observation from the API
+// and caches it. If the API response can't be decoded, the last cached data is
+// returned however old it is, so that an upstream outage page doesn't blank
+// the station, and stale is set.
+func fetchWeatherDataOrStale(ctx context.Context, stationID, units, precision string) (data WeatherData, stale bool, err error) {
+	data, err = fetchWeatherData(ctx, apiBaseURL, stationID, units, precision)
+	if errors.Is(err, errDecode) {
+		if cached, ok := cache.getStale(stationID, units, precision); ok {
+			loggerFor(ctx).Warn("Serving stale cached data", "station_id", stationID, "error", err)
+			return cached, true, nil
+		}
+	}
+	if err != nil {
+		return WeatherData{}, false, err
+	}
+	cache.set(stationID, units, precision, data)
+	return data, false, nil
+}
+
+// parseStations returns the stations requested by the station_id and name
+// query parameters, each of which may be repeated or comma-separated.
+func parseStations(query url.Values) ([]station, error) {
+	units := query.Get("units")
+	if units == "" {
+		units = defaultUnits
+	}
+	if !validUnits[units] {
+		return nil, errors.New("units must be one of m, e, h or s")
+	}
+
+	precision := query.Get("precision")
+	if precision == "" {
+		precision = defaultPrecision
+	}
+	if precision != "decimal" && precision != "integer" {
+		return nil, errors.New("precision must be decimal or integer")
+	}
+
+	var stations []station
+	for _, stationID := range splitQuery(query["station_id"]) {
+		// The API only knows station IDs in upper case.
+		stationID = strings.ToUpper(stationID)
+		if !stationIDPattern.MatchString(stationID) {
+			return nil, fmt.Errorf("invalid station_id %q: expected letters and digits", stationID)
+		}
+		stations = append(stations, station{ID: stationID, Units: units, Precision: precision})
+	}
+	for _, name := range splitQuery(query["name"]) {
+		sc, ok := currentConfig().Stations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown station name %q", name)
+		}
+		s := station{ID: sc.StationID, Name: name, Units: sc.Units, Precision: precision, Sensors: sc.Sensors, Labels: sc.Labels}
+		if s.Units == "" {
+			s.Units = units
+		}
+		stations = append(stations, s)
+	}
+
+	if len(stations) == 0 {
+		return nil, errors.New("station_id or name query parameter is required")
+	}
+
+	// A station requested twice would be collected twice, failing the
+	// scrape with duplicate series.
+	seen := make(map[[2]string]bool, len(stations))
+	unique := stations[:0]
+	for _, s := range stations {
+		key := [2]string{s.ID, s.Name}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique, nil
+}
+
+// splitQuery splits comma-separated query values, dropping empty entries.
+func splitQuery(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
+// httpError replies with an error message as plain text, telling proxies
+// not to cache the response.
+func httpError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, message, code)
+}
+
+// handleScrape serves the metrics of the stations requested in the query.
+func handleScrape(w http.ResponseWriter, r *http.Request) {
+	stations, err := parseStations(r.URL.Query())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	normalize := r.URL.Query().Get("normalize")
+	if normalize != "" && normalize != "si" && normalize != "mm" {
+		httpError(w, "normalize must be si or mm", http.StatusBadRequest)
+		return
+	}
+
+	tempUnit := r.URL.Query().Get("temp_unit")
+	if tempUnit == "celsius" {
+		tempUnit = ""
+	}
+	if tempUnit != "" && tempUnit != "kelvin" {
+		httpError(w, "temp_unit must be celsius or kelvin", http.StatusBadRequest)
+		return
+	}
+
+	pressureUnit := r.URL.Query().Get("pressure_unit")
+	if pressureUnit != "" && pressureUnit != "hPa" && pressureUnit != "inHg" && pressureUnit != "mmHg" {
+		httpError(w, "pressure_unit must be hPa, inHg or mmHg", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := withScrapeTimeout(r.Context(), r)
+	defer cancel()
+
+	var history int
+	if value := r.URL.Query().Get("history"); value != "" {
+		history, err = strconv.Atoi(value)
+		if err != nil || history < 1 || history > maxHistoryHours {
+			httpError(w, fmt.Sprintf("history must be a number of hours from 1 to %d", maxHistoryHours), http.StatusBadRequest)
+			return
+		}
+	}
+
+	collector := &WeatherCollector{
+		ctx:          ctx,
+		history:      history,
+		stations:     stations,
+		mode:         outputMode{normalize: normalize, tempUnit: tempUnit},
+		pressureUnit: pressureUnit,
+	}
+	registry := prometheus.NewRegistry()
+	registerWithExtraLabels(registry, collector, &stationLabelsCollector{
+		stations: func() []station { return stations },
+	})
+
+	// Gather before writing the response so that a scrape of only unknown
+	// stations can be answered with 404 rather than a page of up=0.
+	families, err := registry.Gather()
+	if int(collector.notFound.Load()) == len(stations) {
+		httpError(w, "station not found", http.StatusNotFound)
+		return
+	}
+	// Likewise a scrape whose stations all timed out is answered with 504,
+	// to tell a slow API apart from a failing exporter.
+	if int(collector.timedOut.Load()) == len(stations) {
+		httpError(w, "timed out fetching weather data", http.StatusGatewayTimeout)
+		return
+	}
+
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, err
+	})
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// newTransport returns the transport of httpClient, trusting the CA
+// certificates in the PEM file caCertFile, if set, on top of the system's.
+// insecure disables certificate verification altogether.
+func newTransport(caCertFile string, insecure bool) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCertFile == "" && !insecure {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// listen opens the listening socket for address. An IPv4 host, including
+// 0.0.0.0, binds IPv4 only; an empty host or [::] binds both IPv4 and IPv6
+// where the system supports dual-stack sockets. IPv6 hosts must be bracketed.
+func listen(address string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		// With more than one colon the host is an unbracketed IPv6 address.
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return nil, fmt.Errorf("invalid listen address %q, IPv6 addresses must be bracketed as in [::]:%s: %w", address, defaultPort, err)
+		}
+		return nil, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+
+	// Go would otherwise open a dual-stack socket for 0.0.0.0 too.
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		network = "tcp4"
+	}
+	return net.Listen(network, address)
+}
+
+// handleDebugStation returns the current observation of a single station as
+// returned by the API, pretty-printed.
+func handleDebugStation(w http.ResponseWriter, r *http.Request) {
+	stations, err := parseStations(r.URL.Query())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(stations) != 1 {
+		httpError(w, "exactly one station is required", http.StatusBadRequest)
+		return
+	}
+	s := stations[0]
+
+	// Neither the response body nor fetchAPI's errors contain the API key.
+	body, statusCode, err := fetchAPI(r.Context(), apiBaseURL, currentObsPath, url.Values{
+		"stationId":        {s.ID},
+		"units":            {s.Units},
+		"numericPrecision": {s.Precision},
+	})
+	if isTimeout(err) {
+		httpError(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if statusCode == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		httpError(w, fmt.Sprintf("%v: %v", errDecode, err), http.StatusBadGateway)
+		return
+	}
+	out.WriteByte('\n')
+	w.Header().Set("Content-Type", "application/json")
+	out.WriteTo(w)
+}
+
 func main() {
+	parseFlags()
+
+	if maxConcurrency < 1 {
+		fatal("WU_CONCURRENCY must be at least 1", "value", maxConcurrency)
+	}
+	if !metricPrefixPattern.MatchString(metricPrefix) {
+		fatal("Invalid WU_METRIC_PREFIX", "value", metricPrefix)
+	}
+	if !strings.HasPrefix(metricsPath, "/") || !strings.HasPrefix(scrapePath, "/") || metricsPath == scrapePath {
+		fatal("WU_METRICS_PATH and WU_SCRAPE_PATH must be different paths starting with /",
+			"metrics_path", metricsPath, "scrape_path", scrapePath)
+	}
+	if err := checkExtraLabels(); err != nil {
+		fatal("Invalid WU_EXTRA_LABELS", "error", err)
+	}
+
+	// A private CA is needed behind an intercepting proxy. Skipping
+	// verification is only meant for testing.
+	insecureSkipVerify := os.Getenv("WU_INSECURE_SKIP_VERIFY") == "true"
+	transport, err := newTransport(os.Getenv("WU_CA_CERT_FILE"), insecureSkipVerify)
+	if err != nil {
+		fatal("Failed to load WU_CA_CERT_FILE", "error", err)
+	}
+	httpClient.Transport = transport
+	if insecureSkipVerify {
+		logger.Warn("TLS certificate verification of upstream requests is disabled by WU_INSECURE_SKIP_VERIFY")
+	}
+
+	configPath := *configFile
+	if configPath != "" {
+		c, err := loadConfig(configPath)
+		if err != nil {
+			fatal("Failed to load config", "error", err)
+		}
+		setConfig(c)
+		logger.Info("Loaded config", "path", configPath, "stations", len(c.Stations))
+	}
+
+	// Stations from the file_sd file are added to those of WU_CONFIG, and
+	// reloaded when the file changes.
+	fileSDPath := *fileSDFile
+	var fileSD *fileSDWatcher
+	if fileSDPath != "" {
+		fileSD = newFileSDWatcher(fileSDPath, currentConfig())
+		if err := fileSD.reload(); err != nil {
+			fatal("Failed to load file_sd stations", "error", err)
+		}
+	}
+
+	if *validateConfig {
+		if len(currentConfig().Stations) == 0 {
+			fatal("-validate requires stations to be configured in WU_CONFIG or WU_FILE_SD")
+		}
+		if !validateStations(context.Background(), os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	registerSelfMetrics()
+
 	router := mux.NewRouter()
-	router.HandleFunc("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}).ServeHTTP)
-	router.HandleFunc("/scrape", func(w http.ResponseWriter, r *http.Request) {
-		stationID := r.URL.Query().Get("station_id")
-		if stationID == "" {
-			http.Error(w, "station_id query parameter is required", http.StatusBadRequest)
+	router.Handle(metricsPath, requireAuth(instrumentHandler(metricsPath, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}))))
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		key, err := getAPIKey()
+		if err != nil {
+			httpError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if key == "" {
+			httpError(w, "API key is not set", http.StatusServiceUnavailable)
 			return
 		}
 
-		weatherData, err := fetchWeatherData(stationID)
+		if healthCheckStation != "" {
+			_, err := fetchCachedWeatherData(r.Context(), healthCheckStation, defaultUnits, defaultPrecision)
+			var apiErr *apiError
+			if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+				httpError(w, "API key was rejected", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		fmt.Fprintln(w, "OK")
+	})
+	router.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionInfo{Version: version, Commit: commit, BuildDate: buildDate})
+	})
+	router.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targets.list())
+	})
+	router.Handle("/history", requireAuth(withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stations, err := parseStations(r.URL.Query())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch weather data: %s", err), http.StatusInternalServerError)
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			date = time.Now().Format(historyDateLayout)
+		}
+		if _, err := time.Parse(historyDateLayout, date); err != nil {
+			httpError(w, "date must be formatted as YYYYMMDD", http.StatusBadRequest)
 			return
 		}
 
 		registry := prometheus.NewRegistry()
-		weatherMetrics := newWeatherMetrics()
-		for _, metric := range weatherMetrics {
-			registry.MustRegister(metric)
+		registerWithExtraLabels(registry, &HistoryCollector{ctx: r.Context(), stations: stations, date: date})
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}))))
+	if os.Getenv("WU_DEBUG") == "true" {
+		router.Handle("/debug/station", requireAuth(withRequestID(http.HandlerFunc(handleDebugStation))))
+	}
+	var reloader *configReloader
+	if configPath != "" {
+		reloader = &configReloader{path: configPath, fileSD: fileSD}
+		router.Handle("/reload", requireAuth(reloader)).Methods(http.MethodPost)
+	}
+	// In background polling mode /metrics also serves the weather data of
+	// every configured station.
+	var backgroundPoller *poller
+	if os.Getenv("WU_BACKGROUND_POLL") == "true" {
+		if len(currentConfig().Stations) == 0 {
+			fatal("WU_BACKGROUND_POLL requires stations to be configured in WU_CONFIG or WU_FILE_SD")
 		}
+		backgroundPoller = newPoller()
+		registerWithExtraLabels(prometheus.DefaultRegisterer, backgroundPoller, &stationLabelsCollector{
+			stations: func() []station { return currentConfig().stations() },
+		})
+	}
 
-		for sensor, value := range weatherData.Sensors {
-			if metric, ok := weatherMetrics[sensor]; ok {
-				metric.WithLabelValues(stationID, weatherData.Neighborhood, weatherData.SoftwareType, weatherData.Country).Set(value)
-			}
+	// Stations uploading to the exporter are served on /metrics, like the
+	// polled ones.
+	if uploadPath != "" {
+		if !strings.HasPrefix(uploadPath, "/") || uploadPath == metricsPath || uploadPath == scrapePath {
+			fatal("WU_UPLOAD_PATH must be a path starting with / other than WU_METRICS_PATH and WU_SCRAPE_PATH", "value", uploadPath)
 		}
+		if uploadPassword == "" {
+			fatal("WU_UPLOAD_PATH requires WU_UPLOAD_PASSWORD")
+		}
+		receiver := newUploadReceiver(backgroundPoller != nil)
+		registerWithExtraLabels(prometheus.DefaultRegisterer, receiver)
+		router.Handle(uploadPath, receiver)
+	}
 
-		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-	})
+	pushgatewayURL := os.Getenv("WU_PUSHGATEWAY_URL")
+	if pushgatewayURL == "" {
+		router.Handle(scrapePath, requireAuth(instrumentHandler(scrapePath, withRequestID(http.HandlerFunc(handleScrape)))))
+	} else if len(currentConfig().Stations) == 0 {
+		fatal("WU_PUSHGATEWAY_URL requires stations to be configured in WU_CONFIG or WU_FILE_SD")
+	}
+
+	links := []landingLink{{metricsPath, "Exporter metrics"}}
+	if pushgatewayURL == "" {
+		links = append(links, landingLink{scrapePath + "?station_id=KCASANFR123", "Weather metrics of a station"})
+	}
+	links = append(links,
+		landingLink{"/history?station_id=KCASANFR123", "Daily summary metrics of a station"},
+		landingLink{"/targets", "Status of the scraped stations"},
+		landingLink{"/healthz", "Health check"},
+		landingLink{"/version", "Version information"},
+	)
+	router.Handle("/", landingPage(links))
+
+	server := &http.Server{
+		Addr:    *listenAddress,
+		Handler: router,
+	}
+
+	tlsCertFile := os.Getenv("WU_TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("WU_TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		fatal("WU_TLS_CERT_FILE and WU_TLS_KEY_FILE must be set together")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+
+	if fileSD != nil {
+		go fileSD.run(ctx, durationFromEnv("WU_FILE_SD_REFRESH", defaultFileSDRefresh))
+	}
+	if reloader != nil {
+		go reloader.run(ctx)
+	}
+
+	if backgroundPoller != nil {
+		// The poll interval defaults to the cache TTL, so that scrapes
+		// between polls are served from the cache.
+		interval := cache.ttl
+		if interval <= 0 {
+			interval = defaultCacheTTL
+		}
+		interval = durationFromEnv("WU_POLL_INTERVAL", interval)
+		if interval <= 0 {
+			fatal("WU_POLL_INTERVAL must be positive", "value", interval.String())
+		}
+		if pollJitter < 0 || pollJitter >= 1 {
+			fatal("WU_POLL_JITTER must be at least 0 and less than 1", "value", pollJitter)
+		}
+		logger.Info("Polling stations in the background", "interval", interval.String())
+		go backgroundPoller.run(ctx, interval, pollJitter)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	if pushgatewayURL != "" {
+		interval := durationFromEnv("WU_PUSH_INTERVAL", defaultPushInterval)
+		logger.Info("Pushing to Pushgateway", "url", pushgatewayURL, "interval", interval.String())
+		go runPusher(ctx, pushgatewayURL, interval)
+	}
+
+	listener, err := listen(*listenAddress)
+	if err != nil {
+		fatal("Failed to listen", "error", err)
 	}
 
-	log.Printf("Listening on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	go func() {
+		logger.Info("Listening", "address", listener.Addr().String(), "tls", tlsCertFile != "")
+		var err error
+		if tlsCertFile != "" {
+			err = server.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Graceful shutdown failed", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("Failed to flush traces", "error", err)
+	}
 }
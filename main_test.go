@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// observationJSON is a current observations response for a station reporting
+// every sensor, in metric units.
+const observationJSON = `{"observations":[{
+	"stationID": "KTEST1",
+	"obsTimeUtc": "2026-10-15T08:50:00Z",
+	"obsTimeLocal": "2026-10-15 01:50:00",
+	"neighborhood": "Test Hill",
+	"softwareType": "WS-2902",
+	"country": "US",
+	"solarRadiation": 120.5,
+	"lon": -122.4,
+	"realtimeFrequency": null,
+	"epoch": 1791967800,
+	"lat": 37.7,
+	"uv": 1.0,
+	"winddir": 350,
+	"humidity": 82.0,
+	"qcStatus": 1,
+	"metric": {
+		"temp": 14.2, "heatIndex": 14.2, "dewpt": 11.1, "windChill": 14.2,
+		"windSpeed": 7.2, "windGust": 10.8, "pressure": 1016.6,
+		"precipRate": 0.0, "precipTotal": 1.2, "elev": 52.0
+	}
+}]}`
+
+// newTestAPI starts a server standing in for the WU API, answering every
+// request with status and body, and returns its URL. Retries are turned off
+// for the duration of the test.
+func newTestAPI(t *testing.T, status int, body string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	retries := maxRetries
+	maxRetries = 0
+	t.Cleanup(func() { maxRetries = retries })
+	return srv.URL
+}
+
+// useTestAPI points apiBaseURL at url, with an empty cache, for the duration
+// of the test.
+func useTestAPI(t *testing.T, url string) {
+	t.Helper()
+
+	baseURL, weatherCache := apiBaseURL, cache
+	apiBaseURL, cache = url, newWeatherCache(defaultCacheTTL, 0)
+	t.Cleanup(func() { apiBaseURL, cache = baseURL, weatherCache })
+}
+
+// scrapeTestAPI serves a /scrape request with query through handleScrape,
+// fetching from a test API answering with status and body.
+func scrapeTestAPI(t *testing.T, status int, body, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	useTestAPI(t, newTestAPI(t, status, body))
+	rec := httptest.NewRecorder()
+	handleScrape(rec, httptest.NewRequest(http.MethodGet, "/scrape?"+query, nil))
+	return rec
+}
+
+// fetchTestObservation fetches station KTEST1 in metric units from a test API
+// answering with status and body.
+func fetchTestObservation(t *testing.T, status int, body string) (WeatherData, error) {
+	t.Helper()
+	return fetchWeatherData(context.Background(), newTestAPI(t, status, body), "KTEST1", "m", defaultPrecision)
+}
+
+func TestFetchWeatherData(t *testing.T) {
+	data, err := fetchTestObservation(t, http.StatusOK, observationJSON)
+	if err != nil {
+		t.Fatalf("fetchWeatherData: %v", err)
+	}
+
+	if data.StationID != "KTEST1" {
+		t.Errorf("StationID = %q, want KTEST1", data.StationID)
+	}
+	if data.Epoch != 1791967800 {
+		t.Errorf("Epoch = %d, want 1791967800", data.Epoch)
+	}
+	if want := time.Date(2026, 10, 15, 8, 50, 0, 0, time.UTC); !data.ObsTime.Equal(want) {
+		t.Errorf("ObsTime = %v, want %v", data.ObsTime, want)
+	}
+	if data.Neighborhood != "Test Hill" || data.SoftwareType != "WS-2902" || data.Country != "US" {
+		t.Errorf("Neighborhood, SoftwareType, Country = %q, %q, %q", data.Neighborhood, data.SoftwareType, data.Country)
+	}
+
+	for sensor, want := range map[string]float64{
+		sensorTemperature:        14.2,
+		sensorDewPoint:           11.1,
+		sensorHumidity:           82,
+		sensorPressure:           1016.6,
+		sensorWindSpeed:          7.2,
+		sensorWindGust:           10.8,
+		sensorWindDirection:      350,
+		sensorPrecipitationRate:  0,
+		sensorPrecipitationTotal: 1.2,
+		sensorUVIndex:            1,
+		sensorSolarRadiation:     120.5,
+		sensorElevation:          52,
+		sensorLatitude:           37.7,
+		sensorLongitude:          -122.4,
+		sensorQCStatus:           1,
+	} {
+		if got, ok := data.Sensors[sensor]; !ok || got != want {
+			t.Errorf("Sensors[%q] = %v, %t, want %v", sensor, got, ok, want)
+		}
+	}
+}
+
+func TestFetchWeatherDataErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantErr    error
+		wantStatus int
+	}{
+		{
+			name:    "empty observations",
+			status:  http.StatusOK,
+			body:    `{"observations":[]}`,
+			wantErr: errNoObservations,
+		},
+		{
+			name:       "unauthorized",
+			status:     http.StatusUnauthorized,
+			body:       `{"errors":[{"error":{"code":"CDN-0001","message":"Invalid apiKey."}}],"success":false}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "server error",
+			status:     http.StatusInternalServerError,
+			body:       "oops",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:    "missing observations",
+			status:  http.StatusOK,
+			body:    `{"metadata":{"version":"2"}}`,
+			wantErr: errDecode,
+		},
+		{
+			name:    "null observations",
+			status:  http.StatusOK,
+			body:    `{"observations":null}`,
+			wantErr: errNoObservations,
+		},
+		{
+			name:    "malformed JSON",
+			status:  http.StatusOK,
+			body:    "<html>",
+			wantErr: errDecode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := fetchTestObservation(t, tt.status, tt.body)
+			if err == nil {
+				t.Fatalf("fetchWeatherData returned %+v, want an error", data)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantStatus != 0 {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantStatus {
+					t.Errorf("error = %v, want an apiError with status %d", err, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyObservations(t *testing.T) {
+	_, err := fetchTestObservation(t, http.StatusOK, `{"observations":[]}`)
+	if !errors.Is(err, errStationNotFound) || !errors.Is(err, errNoObservations) {
+		t.Fatalf("error = %v, want %v and %v", err, errStationNotFound, errNoObservations)
+	}
+	if !strings.Contains(err.Error(), "KTEST1") {
+		t.Errorf("error %q doesn't name the station", err)
+	}
+
+	rec := scrapeTestAPI(t, http.StatusOK, `{"observations":[]}`, "station_id=KEMPTY1")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/scrape status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestFetchWeatherDataOrStale(t *testing.T) {
+	useTestAPI(t, newTestAPI(t, http.StatusOK, "<html>"))
+
+	stale := WeatherData{StationID: "KSTALE1", Epoch: 1791967800, Sensors: map[string]float64{sensorTemperature: 14.2}}
+	cache.set("KSTALE1", "m", defaultPrecision, stale)
+
+	data, isStale, err := fetchWeatherDataOrStale(context.Background(), "KSTALE1", "m", defaultPrecision)
+	if err != nil || !isStale {
+		t.Fatalf("fetchWeatherDataOrStale = %t, %v, want stale data", isStale, err)
+	}
+	if data.Epoch != stale.Epoch || data.Sensors[sensorTemperature] != 14.2 {
+		t.Errorf("fetchWeatherDataOrStale = %+v, want the cached %+v", data, stale)
+	}
+
+	if _, _, err := fetchWeatherDataOrStale(context.Background(), "KSTALE2", "m", defaultPrecision); !errors.Is(err, errDecode) {
+		t.Errorf("without cached data, error = %v, want %v", err, errDecode)
+	}
+}
+
+// unitsObservationJSON is an observation carrying the readings of every unit
+// system, as returned for the same station with units m, e, h and s.
+const unitsObservationJSON = `{
+	"stationID": "KTEST1",
+	"metric":    {"temp": 14.2, "windSpeed": 7.2, "pressure": 1016.6, "precipTotal": 1.2},
+	"imperial":  {"temp": 57.6, "windSpeed": 4.5, "pressure": 30.02, "precipTotal": 0.05},
+	"uk_hybrid": {"temp": 14.2, "windSpeed": 4.5, "pressure": 1016.6, "precipTotal": 1.2},
+	"metric_si": {"temp": 14.2, "windSpeed": 2.0, "pressure": 1016.6, "precipTotal": 1.2}
+}`
+
+func TestObservationMeasurements(t *testing.T) {
+	var obs Observation
+	if err := json.Unmarshal([]byte(unitsObservationJSON), &obs); err != nil {
+		t.Fatalf("decoding observation: %v", err)
+	}
+
+	tests := []struct {
+		units                                  string
+		temp, windSpeed, pressure, precipTotal float64
+	}{
+		{"m", 14.2, 7.2, 1016.6, 1.2},
+		{"e", 57.6, 4.5, 30.02, 0.05},
+		{"h", 14.2, 4.5, 1016.6, 1.2},
+		{"s", 14.2, 2.0, 1016.6, 1.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.units, func(t *testing.T) {
+			m := obs.measurements(tt.units)
+			for _, r := range []struct {
+				name string
+				got  *float64
+				want float64
+			}{
+				{"temp", m.Temp, tt.temp},
+				{"windSpeed", m.WindSpeed, tt.windSpeed},
+				{"pressure", m.Pressure, tt.pressure},
+				{"precipTotal", m.PrecipTotal, tt.precipTotal},
+			} {
+				if r.got == nil || *r.got != r.want {
+					t.Errorf("%s = %v, want %v", r.name, r.got, r.want)
+				}
+			}
+			if m.DewPt != nil {
+				t.Errorf("dewpt = %v, want nil as the fixture has none", *m.DewPt)
+			}
+		})
+	}
+}
+
+func TestNullReadings(t *testing.T) {
+	body := strings.NewReplacer(`"uv": 1.0`, `"uv": null`, `"solarRadiation": 120.5`, `"solarRadiation": null`).Replace(observationJSON)
+	data, err := fetchTestObservation(t, http.StatusOK, body)
+	if err != nil {
+		t.Fatalf("fetchWeatherData: %v", err)
+	}
+
+	for _, sensor := range []string{sensorUVIndex, sensorSolarRadiation} {
+		if v, ok := data.Sensors[sensor]; ok {
+			t.Errorf("Sensors[%q] = %v, want it absent for a null reading", sensor, v)
+		}
+	}
+	if _, ok := data.Sensors[sensorTemperature]; !ok {
+		t.Errorf("Sensors[%q] is missing", sensorTemperature)
+	}
+
+	series := collectTestMetrics(t, station{ID: "KTEST1", Units: "m"}, data)
+	for _, name := range []string{"uv", "solarRadiation"} {
+		if v, ok := series[metricName(name)]; ok {
+			t.Errorf("%s = %v is exported for a null reading", name, v)
+		}
+	}
+}
+
+func TestFetchBodyGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(observationJSON))
+	gz.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	before := testutil.ToFloat64(apiReceivedBytesTotal)
+	body, status, err := fetchBody(context.Background(), srv.URL, "")
+	if err != nil {
+		t.Fatalf("fetchBody: %v", err)
+	}
+	if status != http.StatusOK || string(body) != observationJSON {
+		t.Errorf("fetchBody = %d, %q, want the decompressed observation", status, body)
+	}
+	if got, want := testutil.ToFloat64(apiReceivedBytesTotal)-before, float64(compressed.Len()); got != want {
+		t.Errorf("received bytes grew by %v, want the %v compressed bytes", got, want)
+	}
+}
+
+func TestFetchWeatherDataIntegerPrecision(t *testing.T) {
+	var precision string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		precision = r.URL.Query().Get("numericPrecision")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"observations":[{"stationID":"KTEST1","epoch":1791967800,"humidity":82,"winddir":350,
+			"metric":{"temp":21,"dewpt":11,"windSpeed":7,"pressure":1017,"precipTotal":1}}]}`))
+	}))
+	defer srv.Close()
+
+	data, err := fetchWeatherData(context.Background(), srv.URL, "KTEST1", "m", "integer")
+	if err != nil {
+		t.Fatalf("fetchWeatherData: %v", err)
+	}
+	if precision != "integer" {
+		t.Errorf("numericPrecision = %q, want integer", precision)
+	}
+	for sensor, want := range map[string]float64{
+		sensorTemperature:        21,
+		sensorDewPoint:           11,
+		sensorHumidity:           82,
+		sensorWindSpeed:          7,
+		sensorWindDirection:      350,
+		sensorPressure:           1017,
+		sensorPrecipitationTotal: 1,
+	} {
+		if got, ok := data.Sensors[sensor]; !ok || got != want {
+			t.Errorf("Sensors[%q] = %v, %t, want %v", sensor, got, ok, want)
+		}
+	}
+}
+
+func TestScrapeUppercasesStationID(t *testing.T) {
+	var stationID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stationID = r.URL.Query().Get("stationId")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Replace(observationJSON, "KTEST1", stationID, 1)))
+	}))
+	defer srv.Close()
+	useTestAPI(t, srv.URL)
+
+	rec := httptest.NewRecorder()
+	handleScrape(rec, httptest.NewRequest(http.MethodGet, "/scrape?station_id=kcasanfr123", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/scrape status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if stationID != "KCASANFR123" {
+		t.Errorf("upstream stationId = %q, want KCASANFR123", stationID)
+	}
+	if !strings.Contains(rec.Body.String(), `stationID="KCASANFR123"`) {
+		t.Errorf("/scrape output has no series for KCASANFR123:\n%s", rec.Body)
+	}
+}
+
+func TestSoilProbes(t *testing.T) {
+	data, err := fetchTestObservation(t, http.StatusOK, `{"observations":[{
+		"stationID": "KTEST1", "epoch": 1791967800,
+		"soilMoisture1": 31, "soilMoisture2": 27,
+		"metric": {"temp": 14.2, "soilTemp1": 12.5, "soilTemp2": 11.0}
+	}]}`)
+	if err != nil {
+		t.Fatalf("fetchWeatherData: %v", err)
+	}
+
+	series := collectTestMetrics(t, station{ID: "KTEST1", Units: "m"}, data)
+	for key, want := range map[string]float64{
+		metricName("soilTemp") + "/1":     12.5,
+		metricName("soilTemp") + "/2":     11.0,
+		metricName("soilMoisture") + "/1": 31,
+		metricName("soilMoisture") + "/2": 27,
+	} {
+		if got, ok := series[key]; !ok || got != want {
+			t.Errorf("%s = %v, %t, want %v", key, got, ok, want)
+		}
+	}
+	for _, name := range []string{"soilTemp", "soilMoisture"} {
+		for _, probe := range []string{"", "3", "4"} {
+			key := metricName(name) + "/" + probe
+			if v, ok := series[key]; ok {
+				t.Errorf("%s = %v is exported for an absent probe", key, v)
+			}
+		}
+	}
+}
+
+func TestTemperatureOnlyStation(t *testing.T) {
+	data, err := fetchTestObservation(t, http.StatusOK, `{"observations":[{
+		"stationID": "KTEST1", "epoch": 1791967800, "lat": 37.7, "lon": -122.4,
+		"humidity": null, "winddir": null, "uv": null, "solarRadiation": null,
+		"metric": {"temp": 14.2}
+	}]}`)
+	if err != nil {
+		t.Fatalf("fetchWeatherData: %v", err)
+	}
+
+	// Besides the temperature, only the station's position and QC status,
+	// which every observation has, and the feels-like temperature derived
+	// from the temperature are expected.
+	want := map[string]float64{
+		sensorTemperature: 14.2,
+		sensorFeelsLike:   14.2,
+		sensorLatitude:    37.7,
+		sensorLongitude:   -122.4,
+		sensorQCStatus:    0,
+	}
+	if !reflect.DeepEqual(data.Sensors, want) {
+		t.Errorf("Sensors = %v, want %v", data.Sensors, want)
+	}
+}
+
+func TestListen(t *testing.T) {
+	ipv6 := true
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		ipv6 = false
+	} else {
+		l.Close()
+	}
+
+	tests := []struct {
+		address   string
+		needsIPv6 bool
+		// dial are the hosts that must accept connections and refuse
+		// those that must not.
+		dial   []string
+		refuse []string
+	}{
+		{address: "127.0.0.1:0", dial: []string{"127.0.0.1"}},
+		{address: "0.0.0.0:0", dial: []string{"127.0.0.1"}, refuse: []string{"::1"}},
+		{address: "[::1]:0", needsIPv6: true, dial: []string{"::1"}},
+		{address: "[::]:0", needsIPv6: true, dial: []string{"::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if tt.needsIPv6 && !ipv6 {
+				t.Skip("IPv6 is unavailable")
+			}
+
+			l, err := listen(tt.address)
+			if err != nil {
+				t.Fatalf("listen(%q): %v", tt.address, err)
+			}
+			defer l.Close()
+			if l.Addr().Network() != "tcp" {
+				t.Errorf("network = %q, want tcp", l.Addr().Network())
+			}
+
+			port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+			for _, host := range tt.dial {
+				conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+				if err != nil {
+					t.Errorf("connecting to %s: %v", host, err)
+					continue
+				}
+				conn.Close()
+			}
+			for _, host := range tt.refuse {
+				if conn, err := net.Dial("tcp", net.JoinHostPort(host, port)); err == nil {
+					conn.Close()
+					t.Errorf("connected to %s, want the connection refused", host)
+				}
+			}
+		})
+	}
+}
+
+func TestListenInvalidAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		wantHint bool
+	}{
+		{"::1:9122", true},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		l, err := listen(tt.address)
+		if err == nil {
+			l.Close()
+			t.Errorf("listen(%q) succeeded, want an error", tt.address)
+			continue
+		}
+		if hint := strings.Contains(err.Error(), "must be bracketed"); hint != tt.wantHint {
+			t.Errorf("listen(%q) = %v, want the IPv6 hint: %t", tt.address, err, tt.wantHint)
+		}
+	}
+}
+
+func TestFetchWeatherDataRedactsAPIKey(t *testing.T) {
+	pool := apiKeys
+	retries := maxRetries
+	apiKeys, maxRetries = newKeyPool("SUPERSECRET", time.Minute), 0
+	t.Cleanup(func() { apiKeys, maxRetries = pool, retries })
+
+	tests := []struct {
+		name    string
+		baseURL string
+	}{
+		{"unparseable URL", "http://exa mple.com"},
+		{"connection refused", "http://127.0.0.1:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fetchWeatherData(context.Background(), tt.baseURL, "KTEST1", "m", defaultPrecision)
+			if err == nil {
+				t.Fatal("fetchWeatherData succeeded, want an error")
+			}
+			if strings.Contains(err.Error(), "SUPERSECRET") {
+				t.Errorf("error contains the API key: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseStationsDeduplicates(t *testing.T) {
+	cfg := currentConfig()
+	setConfig(&Config{Stations: map[string]StationConfig{"backyard": {StationID: "KTEST1"}}})
+	t.Cleanup(func() { setConfig(cfg) })
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"station_id=KTEST1,ktest1", []string{"KTEST1/"}},
+		{"station_id=KTEST1&station_id=KTEST1", []string{"KTEST1/"}},
+		{"station_id=KTEST1,KTEST2,KTEST1", []string{"KTEST1/", "KTEST2/"}},
+		{"name=backyard&name=backyard", []string{"KTEST1/backyard"}},
+		// The same station by ID and by name is exported with different
+		// station_name labels, so both are kept.
+		{"station_id=KTEST1&name=backyard", []string{"KTEST1/", "KTEST1/backyard"}},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stations, err := parseStations(query)
+		if err != nil {
+			t.Errorf("parseStations(%s): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, s := range stations {
+			got = append(got, s.ID+"/"+s.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseStations(%s) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	rec := scrapeTestAPI(t, http.StatusOK, observationJSON, "station_id=KTEST1,ktest1")
+	if rec.Code != http.StatusOK {
+		t.Errorf("/scrape status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
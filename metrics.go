@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Exporter self-metrics, registered on the default registry served at
+// /metrics so they accumulate across scrapes.
+var (
+	scrapesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricName("scrapes_total"),
+		Help: "Total number of station scrapes and background polls, whether served from the cache or the API",
+	})
+	scrapeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricName("scrape_errors_total"),
+		Help: "Total number of station scrapes and background polls that failed",
+	})
+	stationsScraped = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: metricName("stations_scraped"),
+			Help: "Number of distinct stations scraped or polled since the exporter started",
+		},
+		func() float64 { return float64(targets.count()) },
+	)
+
+	apiRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricName("api_requests_total"),
+		Help: "Total number of weather data fetches from the Weather Underground API",
+	})
+	apiRequestErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("api_request_errors_total"),
+			Help: "Total number of failed weather data fetches by error type",
+		},
+		[]string{"type"},
+	)
+	decodeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricName("decode_errors_total"),
+		Help: "Total number of Weather Underground API responses that could not be decoded",
+	})
+	invalidReadingsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("invalid_readings_total"),
+			Help: "Total number of sensor readings dropped as out of range, with WU_VALIDATE=true",
+		},
+		[]string{"sensor"},
+	)
+	apiDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    metricName("api_duration_seconds"),
+		Help:    "Latency of Weather Underground API requests in seconds",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10},
+	})
+	apiReceivedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricName("api_received_bytes_total"),
+		Help: "Total number of response body bytes received from the Weather Underground API, before decompression",
+	})
+	// apiQuotaRemaining has no labels; it is a vec only so that nothing is
+	// exported until the API has sent a quota header.
+	apiQuotaRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("api_quota_remaining"),
+			Help: "Remaining API quota as reported by the X-RateLimit-Remaining response header",
+		},
+		nil,
+	)
+	apiLastStatusCode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("api_last_status_code"),
+			Help: "HTTP status code of the last Weather Underground API response for the station",
+		},
+		[]string{"stationID"},
+	)
+
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("http_requests_total"),
+			Help: "Total number of HTTP requests served by handler and status code",
+		},
+		[]string{"handler", "code"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricName("http_request_duration_seconds"),
+			Help:    "Duration of HTTP requests served by handler and status code in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler", "code"},
+	)
+)
+
+// selfMetrics returns the collectors of the exporter's self-metrics.
+func selfMetrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		newBuildInfo(),
+		scrapesTotal,
+		scrapeErrorsTotal,
+		stationsScraped,
+		apiRequestsTotal,
+		apiRequestErrorsTotal,
+		decodeErrorsTotal,
+		invalidReadingsTotal,
+		apiDuration,
+		apiReceivedBytesTotal,
+		apiQuotaRemaining,
+		apiLastStatusCode,
+		httpRequestsTotal,
+		httpRequestDuration,
+	}
+}
+
+func registerSelfMetrics() {
+	registerWithExtraLabels(prometheus.DefaultRegisterer, selfMetrics()...)
+}
+
+// registerWithExtraLabels registers the collectors on r with extraLabels
+// added to all of their metrics.
+func registerWithExtraLabels(r prometheus.Registerer, collectors ...prometheus.Collector) {
+	prometheus.WrapRegistererWith(extraLabels, r).MustRegister(collectors...)
+}
+
+// checkExtraLabels returns an error if extraLabels clash with the labels of
+// any of the exporter's metrics. Each collector is checked on a registry of
+// its own, as some of them share descriptors.
+func checkExtraLabels() error {
+	collectors := append(selfMetrics(), &WeatherCollector{}, &HistoryCollector{}, newPoller())
+	for _, c := range collectors {
+		r := prometheus.WrapRegistererWith(extraLabels, prometheus.NewRegistry())
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instrumentHandler wraps h to count and time its requests under the given
+// handler label.
+func instrumentHandler(name string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerCounter(
+		httpRequestsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels), h),
+	)
+}
+
+// errorType classifies a fetchWeatherData error for the errors counter.
+func errorType(err error) string {
+	var apiErr *apiError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		if apiErr.StatusCode >= http.StatusInternalServerError {
+			return "http_5xx"
+		}
+		return "http_4xx"
+	case errors.Is(err, errNoObservations):
+		return "empty_observations"
+	case errors.Is(err, errDecode):
+		return "decode_error"
+	case errors.Is(err, errRateLimited):
+		return "rate_limited"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "network"
+	}
+}
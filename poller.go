@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	stationsOnlineDesc = prometheus.NewDesc(
+		metricName("stations_online"),
+		"Number of configured stations whose last background poll succeeded",
+		nil, nil,
+	)
+	stationsTotalDesc = prometheus.NewDesc(
+		metricName("stations_total"),
+		"Number of configured stations polled in the background",
+		nil, nil,
+	)
+	observationStuckDesc = prometheus.NewDesc(
+		metricName("observation_stuck"),
+		"Whether the station has returned the same observation for longer than WU_STUCK_THRESHOLD",
+		[]string{"stationID", "station_name"}, nil,
+	)
+	lastSuccessDesc = prometheus.NewDesc(
+		metricName("last_success_timestamp_seconds"),
+		"Unix time of the last successful background poll of the station",
+		[]string{"stationID", "station_name"}, nil,
+	)
+)
+
+// pollResult is the outcome of the most recent background fetch of a station.
+// stale is set if the fetch failed to decode and data is the last cached
+// observation. lastSuccess, lastEpoch and epochChanged are carried over from
+// earlier polls when the fetch fails or is stale, and pressures across all
+// polls. epochChanged is when a new observation was last seen.
+type pollResult struct {
+	station      station
+	data         WeatherData
+	duration     time.Duration
+	err          error
+	stale        bool
+	lastSuccess  time.Time
+	lastEpoch    int
+	epochChanged time.Time
+	pressures    *pressureRing
+}
+
+// poller fetches the configured stations in the background and exposes the
+// latest results as a collector, so that /metrics serves live weather data
+// without a per-target scrape.
+type poller struct {
+	mu      sync.RWMutex
+	results map[string]pollResult
+}
+
+func newPoller() *poller {
+	return &poller{results: make(map[string]pollResult)}
+}
+
+// run polls all configured stations every interval until ctx is done. Each
+// station's poll is delayed by up to jitter times the interval, so its
+// effective interval varies by ±jitter.
+func (p *poller) run(ctx context.Context, interval time.Duration, jitter float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.poll(ctx, time.Duration(jitter*float64(interval)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches all configured stations, starting each after a random delay
+// of up to maxDelay so that the requests are spread out rather than sent in
+// a burst.
+func (p *poller) poll(ctx context.Context, maxDelay time.Duration) {
+	stations := currentConfig().stations()
+	order := rand.Perm(len(stations))
+	delays := make([]time.Duration, len(stations))
+	if maxDelay > 0 {
+		for i := range delays {
+			delays[i] = time.Duration(rand.Int63n(int64(maxDelay)))
+		}
+		sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	}
+
+	var g errgroup.Group
+	g.SetLimit(maxConcurrency)
+	pollStart := time.Now()
+	for i, idx := range order {
+		s := stations[idx]
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(pollStart.Add(delays[i]))):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		g.Go(func() error {
+			start := time.Now()
+			fetchCtx, cancel := withStationTimeout(ctx)
+			data, stale, err := fetchWeatherDataOrStale(fetchCtx, s.ID, s.Units, s.Precision)
+			cancel()
+			duration := time.Since(start)
+			scrapesTotal.Inc()
+			if err != nil {
+				scrapeErrorsTotal.Inc()
+				logger.Warn("Failed to poll weather data", "station_id", s.ID, "error", err)
+			}
+			// Stale readings are still exported, but the station hasn't
+			// been refreshed.
+			if stale {
+				targets.record(s.ID, errStale)
+			} else {
+				targets.record(s.ID, err)
+			}
+
+			p.mu.Lock()
+			prev := p.results[s.Name]
+			lastSuccess, lastEpoch, epochChanged := prev.lastSuccess, prev.lastEpoch, prev.epochChanged
+			if err == nil && !stale {
+				lastSuccess = time.Now()
+				if data.Epoch != lastEpoch || epochChanged.IsZero() {
+					lastEpoch, epochChanged = data.Epoch, lastSuccess
+				}
+			}
+			// Readings in another unit can't be compared, so the
+			// pressures start over if the station's units change.
+			pressures := prev.pressures
+			if pressures == nil || pressures.units != s.Units {
+				pressures = &pressureRing{units: s.Units}
+			}
+			if pressure, ok := data.Sensors[sensorPressure]; ok && err == nil && !stale {
+				pressures.add(data.ObsTime, pressure)
+			}
+			p.results[s.Name] = pollResult{
+				station:      s,
+				data:         data,
+				duration:     duration,
+				err:          err,
+				stale:        stale,
+				lastSuccess:  lastSuccess,
+				lastEpoch:    lastEpoch,
+				epochChanged: epochChanged,
+				pressures:    pressures,
+			}
+			p.mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+
+	// Forget stations that have been removed from the configuration.
+	configured := make(map[string]bool, len(stations))
+	for _, s := range stations {
+		configured[s.Name] = true
+	}
+	p.mu.Lock()
+	for name := range p.results {
+		if !configured[name] {
+			delete(p.results, name)
+		}
+	}
+	p.mu.Unlock()
+}
+
+func (p *poller) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upDesc
+	ch <- scrapeDurationDesc
+	ch <- stationInfoDesc
+	ch <- stationUnitsInfoDesc
+	ch <- windInfoDesc
+	ch <- stationsOnlineDesc
+	ch <- stationsTotalDesc
+	ch <- lastSuccessDesc
+	ch <- observationStuckDesc
+	ch <- pressureTrendDesc
+	for _, desc := range defaultWeatherMetrics.all() {
+		ch <- desc
+	}
+}
+
+func (p *poller) Collect(ch chan<- prometheus.Metric) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	online := 0
+	for _, result := range p.results {
+		collectWeatherData(ch, result.station, result.data, result.duration, result.err, outputMode{})
+		if result.err == nil && !result.stale {
+			online++
+		}
+		if !result.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue,
+				float64(result.lastSuccess.UnixNano())/1e9, result.station.ID, result.station.Name)
+		}
+		if result.err == nil {
+			stuck := 0.0
+			if time.Since(result.epochChanged) > stuckThreshold {
+				stuck = 1
+			}
+			ch <- prometheus.MustNewConstMetric(observationStuckDesc, prometheus.GaugeValue,
+				stuck, result.station.ID, result.station.Name)
+		}
+		if pressure, ok := result.data.Sensors[sensorPressure]; ok && result.err == nil && result.station.exports(sensorPressure) {
+			if trend, ok := result.pressures.trend(result.data.ObsTime, pressure); ok {
+				ch <- prometheus.MustNewConstMetric(pressureTrendDesc, prometheus.GaugeValue,
+					trend, result.station.ID, result.station.Name)
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(stationsOnlineDesc, prometheus.GaugeValue, float64(online))
+	ch <- prometheus.MustNewConstMetric(stationsTotalDesc, prometheus.GaugeValue, float64(len(p.results)))
+}
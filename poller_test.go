@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPollStaleFallback(t *testing.T) {
+	var body atomic.Value
+	body.Store(strings.ReplaceAll(observationJSON, "KTEST1", "KPOLL1"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+	useTestAPI(t, srv.URL)
+
+	cfg, tracker := currentConfig(), targets
+	setConfig(&Config{Stations: map[string]StationConfig{"backyard": {StationID: "KPOLL1", Units: "m"}}})
+	targets = newTargetTracker()
+	t.Cleanup(func() {
+		setConfig(cfg)
+		targets = tracker
+	})
+
+	scrapes, scrapeErrors := testutil.ToFloat64(scrapesTotal), testutil.ToFloat64(scrapeErrorsTotal)
+	p := newPoller()
+	p.poll(context.Background(), 0)
+	first := p.results["backyard"]
+	if first.err != nil || first.stale || first.lastSuccess.IsZero() {
+		t.Fatalf("first poll = %v, stale %t, last success %v, want a fresh success", first.err, first.stale, first.lastSuccess)
+	}
+
+	// An HTML outage page can't be decoded, so the cached observation is
+	// served in its place.
+	body.Store("<html>")
+	p.poll(context.Background(), 0)
+	second := p.results["backyard"]
+	if second.err != nil || !second.stale {
+		t.Fatalf("second poll = %v, stale %t, want the stale observation", second.err, second.stale)
+	}
+	if second.data.Sensors[sensorTemperature] != 14.2 {
+		t.Errorf("stale temperature = %v, want 14.2", second.data.Sensors[sensorTemperature])
+	}
+	if !second.lastSuccess.Equal(first.lastSuccess) {
+		t.Errorf("last success advanced from %v to %v on a stale poll", first.lastSuccess, second.lastSuccess)
+	}
+	if status := targets.list()[0]; status.Health != "down" || status.LastError != errStale.Error() {
+		t.Errorf("target = %+v, want it down with %q", status, errStale)
+	}
+
+	// Stale data is served without a failure, as on /scrape.
+	if got := testutil.ToFloat64(scrapesTotal) - scrapes; got != 2 {
+		t.Errorf("scrapes_total grew by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(scrapeErrorsTotal) - scrapeErrors; got != 0 {
+		t.Errorf("scrape_errors_total grew by %v, want 0", got)
+	}
+}
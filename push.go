@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const pushJobName = "wunderground"
+
+// runPusher fetches every configured station each interval and pushes its
+// metrics to the Pushgateway at gatewayURL until ctx is done. Each station
+// is pushed to its own group, keyed by a "station" grouping label (the
+// metrics already carry stationID, which the Pushgateway client does not
+// allow as a grouping label).
+func runPusher(ctx context.Context, gatewayURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, s := range currentConfig().stations() {
+			registry := prometheus.NewRegistry()
+			registerWithExtraLabels(registry, &WeatherCollector{ctx: ctx, stations: []station{s}})
+			err := push.New(gatewayURL, pushJobName).
+				Grouping("station", s.ID).
+				Gatherer(registry).
+				Push()
+			if err != nil {
+				logger.Warn("Failed to push metrics", "station_id", s.ID, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// configReloader re-reads the WU_CONFIG file while the exporter runs, on
+// SIGHUP or a POST to /reload. The stations are swapped in one go, so
+// scrapes in flight keep the configuration they started with.
+type configReloader struct {
+	mu     sync.Mutex
+	path   string
+	fileSD *fileSDWatcher
+}
+
+// reload loads the config file and makes it the configuration in effect. If
+// the file fails to load or validate, the current configuration is kept.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+
+	old := currentConfig()
+	if r.fileSD != nil {
+		r.fileSD.setBase(c)
+	} else {
+		setConfig(c)
+	}
+
+	added, removed, changed := diffStations(old, currentConfig())
+	logger.Info("Reloaded config", "path", r.path, "stations", len(c.Stations),
+		"added", added, "removed", removed, "changed", changed)
+	return nil
+}
+
+// ServeHTTP reloads the config, responding with 400 and the error if it
+// couldn't be loaded.
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := r.reload(); err != nil {
+		logger.Warn("Failed to reload config", "path", r.path, "error", err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// run reloads the config on every SIGHUP until ctx is done.
+func (r *configReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if err := r.reload(); err != nil {
+			logger.Warn("Failed to reload config", "path", r.path, "error", err)
+		}
+	}
+}
+
+// diffStations returns the names of the stations added, removed and changed
+// going from one configuration to the other.
+func diffStations(from, to *Config) (added, removed, changed []string) {
+	for name, sc := range to.Stations {
+		prev, ok := from.Stations[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !reflect.DeepEqual(prev, sc):
+			changed = append(changed, name)
+		}
+	}
+	for name := range from.Stations {
+		if _, ok := to.Stations[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
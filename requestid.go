@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+type requestIDKey struct{}
+
+// requestIDPattern matches the X-Request-ID values taken from clients. Any
+// other value is replaced, so that it can't forge log output.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID wraps h so that each request has an ID, taken from its
+// X-Request-ID header or generated, which is logged with every log line
+// about the request and echoed in the response's X-Request-ID header.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggerFor returns the logger for work done on behalf of ctx, which logs
+// the request ID of the request being served, if any.
+func loggerFor(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// targetStatus is the outcome of the most recent fetch for a station.
+type targetStatus struct {
+	StationID   string     `json:"station_id"`
+	Health      string     `json:"health"`
+	LastScrape  time.Time  `json:"last_scrape"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// targetTracker records the status of every station the exporter has
+// fetched, for reporting on /targets.
+type targetTracker struct {
+	mu      sync.Mutex
+	targets map[string]*targetStatus
+}
+
+func newTargetTracker() *targetTracker {
+	return &targetTracker{targets: make(map[string]*targetStatus)}
+}
+
+// count returns the number of distinct stations recorded.
+func (t *targetTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.targets)
+}
+
+func (t *targetTracker) record(stationID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status, ok := t.targets[stationID]
+	if !ok {
+		status = &targetStatus{StationID: stationID}
+		t.targets[stationID] = status
+	}
+
+	now := time.Now()
+	status.LastScrape = now
+	if err != nil {
+		status.Health = "down"
+		status.LastError = err.Error()
+		return
+	}
+	status.Health = "up"
+	status.LastSuccess = &now
+	status.LastError = ""
+}
+
+// list returns a copy of all target statuses sorted by station ID.
+func (t *targetTracker) list() []targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]targetStatus, 0, len(t.targets))
+	for _, status := range t.targets {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StationID < list[j].StationID
+	})
+	return list
+}
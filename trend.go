@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// pressureTrendWindow is the period the pressure trend is computed
+	// over, the usual barometric tendency period.
+	pressureTrendWindow = 3 * time.Hour
+
+	// pressureSampleInterval is the minimum time between the readings kept
+	// for the trend. It bounds the number of readings needed to cover the
+	// window whatever the poll interval.
+	pressureSampleInterval = 10 * time.Minute
+)
+
+var pressureTrendDesc = prometheus.NewDesc(
+	metricName("pressure_trend"),
+	"Change in atmospheric pressure over the last 3 hours, in the station's pressure unit",
+	[]string{"stationID", "station_name"}, nil,
+)
+
+type pressureSample struct {
+	time  time.Time
+	value float64
+}
+
+// pressureRing holds a station's recent pressure readings, at least
+// pressureSampleInterval apart. Once full, the oldest reading is
+// overwritten.
+type pressureRing struct {
+	units   string
+	samples [int(pressureTrendWindow/pressureSampleInterval) + 1]pressureSample
+	next    int
+	count   int
+}
+
+// add records a reading, unless it is too close to the previous one.
+func (r *pressureRing) add(t time.Time, value float64) {
+	if r.count > 0 {
+		last := r.samples[(r.next+len(r.samples)-1)%len(r.samples)]
+		if t.Sub(last.time) < pressureSampleInterval {
+			return
+		}
+	}
+	r.samples[r.next] = pressureSample{time: t, value: value}
+	r.next = (r.next + 1) % len(r.samples)
+	if r.count < len(r.samples) {
+		r.count++
+	}
+}
+
+// trend returns the change from the most recent reading at least
+// pressureTrendWindow older than t to value. It returns false until the
+// ring covers the window.
+func (r *pressureRing) trend(t time.Time, value float64) (float64, bool) {
+	var base *pressureSample
+	for i := 0; i < r.count; i++ {
+		s := &r.samples[i]
+		if t.Sub(s.time) >= pressureTrendWindow && (base == nil || s.time.After(base.time)) {
+			base = s
+		}
+	}
+	if base == nil {
+		return 0, false
+	}
+	return value - base.value, true
+}
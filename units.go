@@ -0,0 +1,233 @@
+package main
+
+import "math"
+
+// temperatureSensors are the sensors holding temperatures.
+var temperatureSensors = []string{
+	sensorTemperature, sensorDewPoint, sensorWindChill, sensorHeatIndex, sensorFeelsLike, sensorWetBulb,
+	sensorSoilTemperature, probeSensor(sensorSoilTemperature, "1"), probeSensor(sensorSoilTemperature, "2"),
+	probeSensor(sensorSoilTemperature, "3"), probeSensor(sensorSoilTemperature, "4"),
+}
+
+// Conversion factors used by normalizeSI and normalizePrecipitation.
+const (
+	kphToMPS   = 1 / 3.6
+	mphToMPS   = 0.44704
+	inHgToHPa  = 33.8639
+	inchesToMM = 25.4
+	feetToM    = 0.3048
+	hPaToMMHg  = 0.750062
+)
+
+// normalizeSI returns a copy of sensors converted from the given unit system
+// to SI-style units: °C, m/s, hPa, mm and m. The conversions applied are:
+//
+//	units=m  wind speed and gust: km/h / 3.6
+//	units=e  temperatures: (°F - 32) * 5/9
+//	         dew point spread: °F * 5/9
+//	         wind speed and gust: mph * 0.44704
+//	         pressure: inHg * 33.8639
+//	         precipitation: in * 25.4
+//	         elevation: ft * 0.3048
+//	units=h  wind speed and gust: mph * 0.44704
+//	         elevation: ft * 0.3048
+//	units=s  none
+//
+// Visibility is not converted.
+func normalizeSI(sensors map[string]float64, units string) map[string]float64 {
+	result := make(map[string]float64, len(sensors))
+	for sensor, value := range sensors {
+		result[sensor] = value
+	}
+
+	scale := func(factor float64, names ...string) {
+		for _, name := range names {
+			if value, ok := result[name]; ok {
+				result[name] = value * factor
+			}
+		}
+	}
+
+	switch units {
+	case "m":
+		scale(kphToMPS, sensorWindSpeed, sensorWindGust)
+	case "e":
+		for _, name := range temperatureSensors {
+			if value, ok := result[name]; ok {
+				result[name] = (value - 32) * 5 / 9
+			}
+		}
+		scale(mphToMPS, sensorWindSpeed, sensorWindGust)
+		scale(inHgToHPa, sensorPressure)
+		scale(5.0/9, sensorDewPointSpread)
+		scale(inchesToMM, sensorPrecipitationRate, sensorPrecipitationTotal)
+		scale(feetToM, sensorElevation)
+	case "h":
+		scale(mphToMPS, sensorWindSpeed, sensorWindGust)
+		scale(feetToM, sensorElevation)
+	}
+	return result
+}
+
+// temperaturesToKelvin returns a copy of sensors with the temperatures
+// converted to kelvins, from °F if fahrenheit is set and °C otherwise.
+func temperaturesToKelvin(sensors map[string]float64, fahrenheit bool) map[string]float64 {
+	result := make(map[string]float64, len(sensors))
+	for sensor, value := range sensors {
+		result[sensor] = value
+	}
+
+	for _, name := range temperatureSensors {
+		value, ok := result[name]
+		if !ok {
+			continue
+		}
+		if fahrenheit {
+			value = (value - 32) * 5 / 9
+		}
+		result[name] = value + 273.15
+	}
+
+	// A temperature difference is the same in kelvins as in °C.
+	if spread, ok := result[sensorDewPointSpread]; ok && fahrenheit {
+		result[sensorDewPointSpread] = spread * 5 / 9
+	}
+	return result
+}
+
+// convertReadings returns sensors, in the units of a units query, converted
+// as selected by mode: normalized with normalize=si or normalize=mm, and with
+// the temperatures in kelvins with temp_unit=kelvin.
+func convertReadings(sensors map[string]float64, units string, mode outputMode) map[string]float64 {
+	switch mode.normalize {
+	case "si":
+		sensors = normalizeSI(sensors, units)
+	case "mm":
+		sensors = normalizePrecipitation(sensors, units)
+	}
+	if mode.tempUnit == "kelvin" {
+		sensors = temperaturesToKelvin(sensors, units == "e" && mode.normalize != "si")
+	}
+	return sensors
+}
+
+// Air temperatures above which the heat index, and below which the wind
+// chill, is used as the feels-like temperature.
+const (
+	heatIndexThresholdC = 26
+	windChillThresholdC = 10
+)
+
+// feelsLike returns the apparent temperature: the heat index when it is hot,
+// the wind chill when it is cold and the air temperature otherwise. The
+// readings are in °F with units=e and in °C otherwise.
+func feelsLike(temp, windChill, heatIndex float64, units string) float64 {
+	tempC := temp
+	if units == "e" {
+		tempC = (temp - 32) * 5 / 9
+	}
+
+	switch {
+	case tempC > heatIndexThresholdC:
+		return heatIndex
+	case tempC < windChillThresholdC:
+		return windChill
+	default:
+		return temp
+	}
+}
+
+// wetBulb returns the wet-bulb temperature for the air temperature and
+// relative humidity, using Stull's approximation (Stull 2011, "Wet-Bulb
+// Temperature from Relative Humidity and Air Temperature"):
+//
+//	Tw = T atan(0.151977 (RH + 8.313659)^½) + atan(T + RH) - atan(RH - 1.676331)
+//	     + 0.00391838 RH^1.5 atan(0.023101 RH) - 4.686035
+//
+// with T in °C and RH in percent. It is accurate to within about 1 °C for
+// RH from 5% to 99% and T from -20 °C to 50 °C, and less so outside of that
+// range. The temperatures are in °F with units=e and in °C otherwise.
+func wetBulb(temp, humidity float64, units string) float64 {
+	t := temp
+	if units == "e" {
+		t = (temp - 32) * 5 / 9
+	}
+	rh := humidity
+
+	tw := t*math.Atan(0.151977*math.Sqrt(rh+8.313659)) +
+		math.Atan(t+rh) - math.Atan(rh-1.676331) +
+		0.00391838*math.Pow(rh, 1.5)*math.Atan(0.023101*rh) -
+		4.686035
+
+	if units == "e" {
+		return tw*9/5 + 32
+	}
+	return tw
+}
+
+// absoluteHumidity returns the water vapour content of the air in g/m³ for
+// the air temperature and relative humidity. The saturation vapour pressure
+// in hPa is given by the Magnus formula, and the vapour treated as an ideal
+// gas:
+//
+//	AH = 6.112 e^(17.67 T / (T + 243.5)) RH 2.1674 / (273.15 + T)
+//
+// with T in °C and RH in percent, so dry air (RH 0%) gives 0. The
+// temperature is in °F with units=e and in °C otherwise.
+func absoluteHumidity(temp, humidity float64, units string) float64 {
+	t := temp
+	if units == "e" {
+		t = (temp - 32) * 5 / 9
+	}
+	if humidity <= 0 {
+		return 0
+	}
+	return 6.112 * math.Exp(17.67*t/(t+243.5)) * humidity * 2.1674 / (273.15 + t)
+}
+
+// withPressureIn returns a copy of sensors with the pressure reading also
+// given in unit, inHg or mmHg, as pressure_inhg or pressure_mmhg. Readings
+// in hPa are divided by 33.8639 for inHg and multiplied by 0.750062 for
+// mmHg; units=e readings are already in inHg and are multiplied by 33.8639
+// first for mmHg. Any other unit returns sensors unchanged.
+func withPressureIn(sensors map[string]float64, units, unit string) map[string]float64 {
+	pressure, ok := sensors[sensorPressure]
+	if !ok || (unit != "inHg" && unit != "mmHg") {
+		return sensors
+	}
+
+	result := make(map[string]float64, len(sensors)+1)
+	for sensor, value := range sensors {
+		result[sensor] = value
+	}
+
+	hPa := pressure
+	if units == "e" {
+		hPa = pressure * inHgToHPa
+	}
+	if unit == "inHg" {
+		result[sensorPressureInHg] = hPa / inHgToHPa
+	} else {
+		result[sensorPressureMMHg] = hPa * hPaToMMHg
+	}
+	return result
+}
+
+// normalizePrecipitation returns a copy of sensors with the precipitation
+// readings converted to millimeters. Only units=e reports precipitation in
+// inches; everything else is returned unchanged.
+func normalizePrecipitation(sensors map[string]float64, units string) map[string]float64 {
+	result := make(map[string]float64, len(sensors))
+	for sensor, value := range sensors {
+		result[sensor] = value
+	}
+
+	if units == "e" {
+		for _, name := range []string{sensorPrecipitationRate, sensorPrecipitationTotal} {
+			if value, ok := result[name]; ok {
+				result[name] = value * inchesToMM
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// approxEqual reports whether got is within tolerance of want.
+func approxEqual(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+func TestWithPressureIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		pressure float64
+		units    string
+		unit     string
+		sensor   string
+		want     float64
+	}{
+		{"hPa to inHg", 1013.25, "m", "inHg", sensorPressureInHg, 29.921},
+		{"hPa to mmHg", 1013.25, "m", "mmHg", sensorPressureMMHg, 760.0},
+		{"inHg to inHg", 29.92, "e", "inHg", sensorPressureInHg, 29.92},
+		{"inHg to mmHg", 29.92, "e", "mmHg", sensorPressureMMHg, 759.97},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sensors := map[string]float64{sensorPressure: tt.pressure}
+			result := withPressureIn(sensors, tt.units, tt.unit)
+			if got, ok := result[tt.sensor]; !ok || !approxEqual(got, tt.want, 0.01) {
+				t.Errorf("%s = %v, %t, want %v", tt.sensor, got, ok, tt.want)
+			}
+			if result[sensorPressure] != tt.pressure {
+				t.Errorf("%s = %v, want it unchanged at %v", sensorPressure, result[sensorPressure], tt.pressure)
+			}
+			if len(sensors) != 1 {
+				t.Errorf("withPressureIn modified its argument: %v", sensors)
+			}
+		})
+	}
+
+	sensors := map[string]float64{sensorPressure: 1013.25}
+	if result := withPressureIn(sensors, "m", "hPa"); len(result) != 1 {
+		t.Errorf("withPressureIn(hPa) = %v, want the readings unchanged", result)
+	}
+}
+
+func TestFeelsLike(t *testing.T) {
+	const windChill, heatIndex = -100, 100
+	tests := []struct {
+		name  string
+		temp  float64
+		units string
+		want  float64
+	}{
+		{"above heat index threshold", 26.1, "m", heatIndex},
+		{"at heat index threshold", 26, "m", 26},
+		{"mild", 18, "m", 18},
+		{"at wind chill threshold", 10, "m", 10},
+		{"below wind chill threshold", 9.9, "m", windChill},
+		{"hot in °F", 79, "e", heatIndex},
+		{"at 26 °C in °F", 78.8, "e", 78.8},
+		{"mild in °F", 64.4, "e", 64.4},
+		{"at 10 °C in °F", 50, "e", 50},
+		{"cold in °F", 49.8, "e", windChill},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := feelsLike(tt.temp, windChill, heatIndex, tt.units); got != tt.want {
+				t.Errorf("feelsLike(%v, %q) = %v, want %v", tt.temp, tt.units, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWetBulb(t *testing.T) {
+	tests := []struct {
+		temp, humidity float64
+		units          string
+		want           float64
+	}{
+		// Stull (2011) gives 13.7 °C for 20 °C at 50% relative humidity.
+		{20, 50, "m", 13.7},
+		{68, 50, "e", 56.66},
+		// Saturated air is at its wet-bulb temperature.
+		{20, 100, "m", 20},
+	}
+	for _, tt := range tests {
+		if got := wetBulb(tt.temp, tt.humidity, tt.units); !approxEqual(got, tt.want, 0.05) {
+			t.Errorf("wetBulb(%v, %v, %q) = %v, want %v", tt.temp, tt.humidity, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	tests := []struct {
+		temp, humidity float64
+		units          string
+		want           float64
+	}{
+		// Air at 20 °C and 50% relative humidity holds about 8.64 g/m³.
+		{20, 50, "m", 8.64},
+		{68, 50, "e", 8.64},
+		{20, 0, "m", 0},
+		{-5, 0, "m", 0},
+	}
+	for _, tt := range tests {
+		if got := absoluteHumidity(tt.temp, tt.humidity, tt.units); !approxEqual(got, tt.want, 0.01) {
+			t.Errorf("absoluteHumidity(%v, %v, %q) = %v, want %v", tt.temp, tt.humidity, tt.units, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// uploadPath, if set, is the path on which the exporter accepts the
+	// observations a station uploads with the WU upload protocol, e.g.
+	// /weatherstation/updateweatherstation.php. Pointing the station (or
+	// its DNS) at the exporter reads it without the WU API.
+	uploadPath = os.Getenv("WU_UPLOAD_PATH")
+
+	// uploadPassword must match the PASSWORD of every upload. It is required
+	// with WU_UPLOAD_PATH, as every station uploading is kept and exported.
+	uploadPassword = os.Getenv("WU_UPLOAD_PASSWORD")
+)
+
+// uploadSensors maps the query parameters of an upload to sensors. The
+// upload protocol always uses imperial units.
+var uploadSensors = map[string]string{
+	"tempf":          sensorTemperature,
+	"dewptf":         sensorDewPoint,
+	"windchillf":     sensorWindChill,
+	"heatindexf":     sensorHeatIndex,
+	"humidity":       sensorHumidity,
+	"winddir":        sensorWindDirection,
+	"windspeedmph":   sensorWindSpeed,
+	"windgustmph":    sensorWindGust,
+	"baromin":        sensorPressure,
+	"rainin":         sensorPrecipitationRate,
+	"dailyrainin":    sensorPrecipitationTotal,
+	"solarradiation": sensorSolarRadiation,
+	"UV":             sensorUVIndex,
+	"visibility":     sensorVisibility,
+	"soiltempf":      sensorSoilTemperature,
+	"soilmoisture":   sensorSoilMoisture,
+	"soiltemp2f":     probeSensor(sensorSoilTemperature, "2"),
+	"soiltemp3f":     probeSensor(sensorSoilTemperature, "3"),
+	"soiltemp4f":     probeSensor(sensorSoilTemperature, "4"),
+	"soilmoisture2":  probeSensor(sensorSoilMoisture, "2"),
+	"soilmoisture3":  probeSensor(sensorSoilMoisture, "3"),
+	"soilmoisture4":  probeSensor(sensorSoilMoisture, "4"),
+	"rtfreq":         sensorRealtimeFrequency,
+}
+
+// uploadMissingValue is sent by some stations for a sensor without a reading.
+const uploadMissingValue = -9999
+
+// uploadDateLayout is the layout of the dateutc parameter of an upload.
+const uploadDateLayout = "2006-01-02 15:04:05"
+
+// parseUpload returns the weather data of an upload's query parameters.
+func parseUpload(ctx context.Context, stationID string, q url.Values) (WeatherData, error) {
+	obsTime := time.Now().UTC()
+	if date := q.Get("dateutc"); date != "" && date != "now" {
+		t, err := time.Parse(uploadDateLayout, date)
+		if err != nil {
+			return WeatherData{}, fmt.Errorf("invalid dateutc %q", date)
+		}
+		obsTime = t
+	}
+
+	data := WeatherData{
+		StationID:    stationID,
+		Epoch:        int(obsTime.Unix()),
+		ObsTime:      obsTime,
+		SoftwareType: q.Get("softwaretype"),
+		Sensors:      make(map[string]float64),
+	}
+	for param, sensor := range uploadSensors {
+		value := q.Get(param)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return WeatherData{}, fmt.Errorf("invalid %s %q", param, value)
+		}
+		if f != uploadMissingValue {
+			data.Sensors[sensor] = f
+		}
+	}
+
+	if validateReadings {
+		dropInvalidReadings(ctx, stationID, data.Sensors)
+	}
+	addDerivedReadings(data.Sensors, "e")
+	return data, nil
+}
+
+// uploadReceiver keeps the latest upload of each station and exposes them as
+// a collector, like the background poller. If polling is set, the background
+// poller runs and uploads of the stations it fetches are refused.
+type uploadReceiver struct {
+	mu      sync.RWMutex
+	uploads map[string]WeatherData
+	polling bool
+}
+
+func newUploadReceiver(polling bool) *uploadReceiver {
+	return &uploadReceiver{uploads: make(map[string]WeatherData), polling: polling}
+}
+
+// polled reports whether the background poller fetches the station. Its
+// uploads would be exported with the same series as the poller's, failing
+// the whole gather.
+func (u *uploadReceiver) polled(stationID string) bool {
+	if !u.polling {
+		return false
+	}
+	for _, s := range currentConfig().stations() {
+		if s.ID == stationID {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP handles a station's upload. Stations expect "success" in
+// response.
+func (u *uploadReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	stationID := strings.ToUpper(q.Get("ID"))
+	if !stationIDPattern.MatchString(stationID) {
+		httpError(w, "invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !secureEqual(q.Get("PASSWORD"), uploadPassword) {
+		httpError(w, "invalid PASSWORD", http.StatusUnauthorized)
+		return
+	}
+	if u.polled(stationID) {
+		logger.Warn("Rejected upload of a polled station", "station_id", stationID)
+		httpError(w, "station is polled from the WU API", http.StatusConflict)
+		return
+	}
+
+	data, err := parseUpload(r.Context(), stationID, q)
+	if err != nil {
+		logger.Warn("Rejected station upload", "station_id", stationID, "error", err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	u.uploads[stationID] = data
+	u.mu.Unlock()
+
+	fmt.Fprintln(w, "success")
+}
+
+// uploadStation returns the station an upload came from, named after the
+// configured station with the same ID if there is one.
+func uploadStation(stationID string) station {
+	s := station{ID: stationID, Precision: defaultPrecision}
+	for _, configured := range currentConfig().stations() {
+		if configured.ID == stationID {
+			s = configured
+			break
+		}
+	}
+	s.Units = "e"
+	return s
+}
+
+// Describe describes nothing, making uploadReceiver an unchecked collector, as
+// its metrics are also those of the background poller.
+func (u *uploadReceiver) Describe(ch chan<- *prometheus.Desc) {}
+
+func (u *uploadReceiver) Collect(ch chan<- prometheus.Metric) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	for stationID, data := range u.uploads {
+		// The station may have been configured since it uploaded.
+		if u.polled(stationID) {
+			continue
+		}
+		collectWeatherData(ch, uploadStation(stationID), data, 0, nil, outputMode{})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uploadTest sends an upload from stationID with password to u and returns
+// the response status.
+func uploadTest(u *uploadReceiver, stationID, password string) int {
+	rec := httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/weatherstation/updateweatherstation.php?ID="+stationID+"&PASSWORD="+password+"&dateutc=now&tempf=57.6", nil))
+	return rec.Code
+}
+
+func TestUploadReceiver(t *testing.T) {
+	password, cfg := uploadPassword, currentConfig()
+	uploadPassword = "secret"
+	setConfig(&Config{Stations: map[string]StationConfig{"backyard": {StationID: "KPOLLED1"}}})
+	t.Cleanup(func() {
+		uploadPassword = password
+		setConfig(cfg)
+	})
+
+	u := newUploadReceiver(true)
+	tests := []struct {
+		name      string
+		stationID string
+		password  string
+		want      int
+	}{
+		{"uploading station", "KUPLOAD1", "secret", http.StatusOK},
+		{"wrong password", "KUPLOAD2", "guess", http.StatusUnauthorized},
+		{"no password", "KUPLOAD3", "", http.StatusUnauthorized},
+		{"polled station", "KPOLLED1", "secret", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got := uploadTest(u, tt.stationID, tt.password); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if len(u.uploads) != 1 {
+		t.Errorf("uploads = %v, want only KUPLOAD1's", u.uploads)
+	}
+
+	// A station configured after uploading is no longer exported from its
+	// uploads once the poller fetches it.
+	setConfig(&Config{Stations: map[string]StationConfig{"backyard": {StationID: "KUPLOAD1"}}})
+	ch := make(chan prometheus.Metric, 100)
+	u.Collect(ch)
+	close(ch)
+	if n := len(ch); n != 0 {
+		t.Errorf("Collect emitted %d metrics for a polled station, want none", n)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// validateStations fetches every configured station once and writes the
+// outcome as a table to w. It reports whether all stations succeeded.
+func validateStations(ctx context.Context, w io.Writer) bool {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATION ID\tUNITS\tRESULT")
+
+	ok := true
+	for _, s := range currentConfig().stations() {
+		result := "ok"
+		if _, err := fetchWeatherData(ctx, apiBaseURL, s.ID, s.Units, s.Precision); err != nil {
+			result = "error: " + err.Error()
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.ID, s.Units, result)
+	}
+
+	tw.Flush()
+	return ok
+}
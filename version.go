@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+func newBuildInfo() prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: metricName("build_info"),
+		Help: "Build information of the exporter, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"buildDate": buildDate,
+		},
+	})
+	g.Set(1)
+	return g
+}